@@ -0,0 +1,162 @@
+package simulator
+
+// Bitset is a dense set of small non-negative integers, e.g. the IDs of miners.
+type Bitset []uint64
+
+func NewBitset(n int) Bitset {
+	return make(Bitset, (n+63)/64)
+}
+
+func (b Bitset) Has(i int) bool {
+	w := i >> 6
+	return w < len(b) && b[w]&(1<<(uint(i)&63)) != 0
+}
+
+// Add returns false if i is in the set already.
+func (b Bitset) Add(i int) bool {
+	w, bit := i>>6, uint64(1)<<(uint(i)&63)
+	if b[w]&bit != 0 {
+		return false
+	}
+	b[w] |= bit
+	return true
+}
+
+// Remove returns false if i is not in the set.
+func (b Bitset) Remove(i int) bool {
+	w, bit := i>>6, uint64(1)<<(uint(i)&63)
+	if w >= len(b) || b[w]&bit == 0 {
+		return false
+	}
+	b[w] &^= bit
+	return true
+}
+
+// List returns the members in increasing order.
+func (b Bitset) List() []int {
+	var list []int
+	for w, word := range b {
+		for bit := 0; word != 0; bit++ {
+			if word&1 != 0 {
+				list = append(list, w*64+bit)
+			}
+			word >>= 1
+		}
+	}
+	return list
+}
+
+// nodeSets holds a set of nodes for each block, e.g. the nodes which have
+// relayed the block, as a bitset indexed by node. Once the set of a block holds
+// every node it is freed and only a flag is kept, so the memory follows the
+// blocks still in flight instead of all the blocks.
+type nodeSets struct {
+	nodes int
+	sets  []Bitset // Indexed by block, nil when empty or full
+	count []int
+	full  []bool
+}
+
+func newNodeSets(nodes int) *nodeSets {
+	return &nodeSets{nodes: nodes}
+}
+
+func (s *nodeSets) grow(block int) {
+	for len(s.full) <= block {
+		s.sets = append(s.sets, nil)
+		s.count = append(s.count, 0)
+		s.full = append(s.full, false)
+	}
+}
+
+func (s *nodeSets) Has(block int, node int) bool {
+	if block >= len(s.full) {
+		return false
+	}
+	return s.full[block] || s.sets[block].Has(node)
+}
+
+// Add returns false if the node is in the set of the block already.
+func (s *nodeSets) Add(block int, node int) bool {
+	if !s.mark(block, node) {
+		return false
+	}
+	s.tally(block)
+	return true
+}
+
+// mark is Add without the count of the set, see tally. Nodes whose bits are in
+// different words of the bitset can mark the same block concurrently, provided
+// the slots and the bitset of the block exist: mark grows the shared slices and
+// creates the bitset without a lock. The miners of the parallel engine broadcast
+// a block when they mine it, so BitcoinNetwork.Broadcast marks its sender from
+// the oracle queue, before any window relays it.
+func (s *nodeSets) mark(block int, node int) bool {
+	s.grow(block)
+	if s.full[block] {
+		return false
+	}
+	if s.sets[block] == nil {
+		s.sets[block] = NewBitset(s.nodes)
+	}
+	return s.sets[block].Add(node)
+}
+
+// tally counts a node marked in the set of the block, and frees the set once it
+// holds every node.
+func (s *nodeSets) tally(block int) {
+	s.count[block]++
+	if s.count[block] == s.nodes {
+		s.sets[block] = nil
+		s.full[block] = true
+	}
+}
+
+func (s *nodeSets) Remove(block int, node int) {
+	if block >= len(s.full) {
+		return
+	}
+	if s.full[block] {
+		set := NewBitset(s.nodes)
+		for i := 0; i < s.nodes; i++ {
+			set.Add(i)
+		}
+		s.sets[block], s.full[block] = set, false
+	}
+	if s.sets[block].Remove(node) {
+		s.count[block]--
+	}
+}
+
+// nodeSetsState lists the blocks with a full set, and the members of the others.
+type nodeSetsState struct {
+	Full   []int
+	Blocks []int
+	Nodes  [][]int
+}
+
+func (s *nodeSets) saveState() *nodeSetsState {
+	state := &nodeSetsState{}
+	for block, full := range s.full {
+		if full {
+			state.Full = append(state.Full, block)
+		} else if s.count[block] > 0 {
+			state.Blocks = append(state.Blocks, block)
+			state.Nodes = append(state.Nodes, s.sets[block].List())
+		}
+	}
+	return state
+}
+
+func (s *nodeSets) loadState(state *nodeSetsState) {
+	s.sets, s.count, s.full = nil, nil, nil
+	for _, block := range state.Full {
+		s.grow(block)
+		s.full[block] = true
+	}
+	for idx, block := range state.Blocks {
+		for _, node := range state.Nodes[idx] {
+			s.Add(block, node)
+		}
+	}
+}
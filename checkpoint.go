@@ -0,0 +1,511 @@
+package simulator
+
+import (
+	"container/list"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync/atomic"
+)
+
+// A checkpoint holds the whole state of a run: the blocks, the event queue, the
+// state of every miner and of the network, and the position of the random
+// streams. Resuming a checkpoint with the same scenario continues the run
+// exactly as if it had not been interrupted.
+
+const checkpointVersion = 5
+
+func init() {
+	gob.Register(&localGraphState{})
+	gob.Register(&honestMinerState{})
+	gob.Register(&withholdMinerState{})
+	gob.Register(&peerNetworkState{})
+	gob.Register(&bitcoinNetworkState{})
+}
+
+type blockState struct {
+	MinerID       int
+	Residual      float64
+	Time          int64
+	Timestamp     int64
+	Difficulty    float64
+	Seen          []int
+	SeenAll       bool
+	Height        int
+	AncestorNum   int
+	Parent        int // -1 for the genesis block and the block not generated yet
+	References    []int
+	Children      []int
+	RefChildren   []int
+	ReceivingTime []int64 // nil if no node or every node has received the block
+	ReceivedNum   int
+	ReceivedSum   int64
+	MinerTime     int64
+	LastTime      int64
+	Adaptive      adaptivity
+}
+
+type eventKind byte
+
+const (
+	genBlockEventKind eventKind = iota + 1
+	sendBlockEventKind
+	broadcastEventKind
+	peerSendEventKind
+	delayInsertEventKind
+	wakeupTrafficEventKind
+	packetEventKind
+	requestTimeoutEventKind
+)
+
+type eventState struct {
+	Kind     eventKind
+	Time     int64
+	Seq      uint64
+	Block    int
+	Sender   int // Sender of the block, or the node of a WakeupTrafficEvent
+	Receiver int // Receiver of the block, the miner of a DelayInsertEvent or the requester of a RequestTimeoutEvent
+	First    bool
+	Packet   *packetState
+}
+
+// OracleState is the serialized form of an oracle, see Oracle.State.
+type OracleState struct {
+	Timestamp int64
+	Blocks    []*blockState
+	Rand      []uint64
+	NextSeq   uint64
+	Events    []*eventState // In the order of the heap
+	Miners    []interface{}
+	Network   interface{}
+	TraceHash []byte // nil if the trace hash is disabled
+	Mined     int
+	Draining  bool
+}
+
+func blockIndices(blocks []*Block) []int {
+	indices := make([]int, len(blocks))
+	for idx, block := range blocks {
+		indices[idx] = block.index
+	}
+	return indices
+}
+
+// copyTimes copies a map of timestamps, so a snapshot can be restored twice.
+func copyTimes(times map[int]int64) map[int]int64 {
+	result := make(map[int]int64, len(times))
+	for key, value := range times {
+		result[key] = value
+	}
+	return result
+}
+
+func restoreBlocks(blocks []*Block, indices []int) []*Block {
+	if len(indices) == 0 {
+		return nil
+	}
+	result := make([]*Block, len(indices))
+	for idx, index := range indices {
+		result[idx] = blocks[index]
+	}
+	return result
+}
+
+// blockList returns the indices of a list of blocks.
+func blockList(l *list.List) []int {
+	indices := make([]int, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		indices = append(indices, e.Value.(*Block).index)
+	}
+	return indices
+}
+
+func restoreBlockList(blocks []*Block, indices []int) *list.List {
+	l := list.New()
+	for _, index := range indices {
+		l.PushBack(blocks[index])
+	}
+	return l
+}
+
+// State returns a snapshot of the oracle. It must be called between two events,
+// e.g. from the callback of EnableCheckpoint. All the miners and the network
+// must implement Stateful.
+func (o *Oracle) State() (*OracleState, error) {
+	if o.replaying {
+		return nil, fmt.Errorf("can not checkpoint the replay of a trace")
+	}
+	state := &OracleState{
+		Timestamp: o.timestamp,
+		Rand:      o.rand.states(),
+		NextSeq:   o.queue.nextSeq,
+		Mined:     o.mined,
+		Draining:  o.draining,
+	}
+
+	for _, block := range o.blocks {
+		bs := &blockState{
+			MinerID:       block.minerID,
+			Residual:      block.residual,
+			Time:          block.time,
+			Timestamp:     block.timestamp,
+			Difficulty:    block.difficulty,
+			Height:        block.height,
+			AncestorNum:   block.ancestorNum,
+			Parent:        -1,
+			References:    blockIndices(block.references),
+			Children:      blockIndices(block.children),
+			RefChildren:   blockIndices(block.refChildren),
+			SeenAll:       block.seen == nil && block.seenNum > 0,
+			Seen:          block.seen.List(),
+			ReceivingTime: block.receivingTime,
+			ReceivedNum:   block.receivedNum,
+			ReceivedSum:   block.receivedSum,
+			MinerTime:     block.minerTime,
+			LastTime:      block.lastTime,
+			Adaptive:      block.adaptive,
+		}
+		if block.parent != nil {
+			bs.Parent = block.parent.index
+		}
+		state.Blocks = append(state.Blocks, bs)
+	}
+
+	var err error
+	o.queue.sched.each(func(event Event) {
+		if err != nil {
+			return
+		}
+		var es *eventState
+		if es, err = saveEvent(event); err == nil {
+			state.Events = append(state.Events, es)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for id, miner := range o.miners.miners {
+		stateful, ok := miner.(Stateful)
+		if !ok {
+			return nil, fmt.Errorf("miner %d (%T) can not be checkpointed", id, miner)
+		}
+		ms, err := stateful.SaveState()
+		if err != nil {
+			return nil, err
+		}
+		state.Miners = append(state.Miners, ms)
+	}
+
+	if o.network != nil {
+		stateful, ok := o.network.(Stateful)
+		if !ok {
+			return nil, fmt.Errorf("network %T can not be checkpointed", o.network)
+		}
+		ns, err := stateful.SaveState()
+		if err != nil {
+			return nil, err
+		}
+		state.Network = ns
+	}
+
+	if o.traceHash != nil {
+		content, err := o.traceHash.(interface{ MarshalBinary() ([]byte, error) }).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		state.TraceHash = content
+	}
+	return state, nil
+}
+
+func saveEvent(event Event) (*eventState, error) {
+	es := &eventState{Time: event.GetTimestamp(), Seq: event.GetSeq()}
+	switch e := event.(type) {
+	case *GenBlockEvent:
+		es.Kind, es.Block = genBlockEventKind, e.block.index
+	case *SendBlockEvent:
+		es.Kind, es.Block, es.Receiver = sendBlockEventKind, e.block.index, e.receiverID
+	case *BroadcastEvent:
+		es.Kind, es.Block, es.Sender = broadcastEventKind, e.block.index, e.senderID
+	case *PeerSendEvent:
+		es.Kind, es.Block, es.Sender, es.First = peerSendEventKind, e.block.index, e.senderID, e.first
+	case *DelayInsertEvent:
+		es.Kind, es.Block, es.Receiver = delayInsertEventKind, e.block.index, e.m.id
+	case *WakeupTrafficEvent:
+		es.Kind = wakeupTrafficEventKind
+		es.Sender = -1
+		for id, node := range e.traffic.nodes {
+			if node == e.sender {
+				es.Sender = id
+			}
+		}
+	case *PacketEvent:
+		packet, err := savePacket(e)
+		if err != nil {
+			return nil, err
+		}
+		packet.Embedded = true
+		es.Kind, es.Packet = packetEventKind, packet
+	case *RequestTimeoutEvent:
+		es.Kind, es.Block, es.Receiver = requestTimeoutEventKind, e.key.block, e.key.receiver
+	case *INVPacketEvent:
+		return savePacketEvent(es, &e.PacketEvent)
+	case *GETPacketEvent:
+		return savePacketEvent(es, &e.PacketEvent)
+	case *GETCompactPacketEvent:
+		return savePacketEvent(es, &e.PacketEvent)
+	default:
+		return nil, fmt.Errorf("event %T can not be checkpointed", event)
+	}
+	return es, nil
+}
+
+func savePacketEvent(es *eventState, e *PacketEvent) (*eventState, error) {
+	packet, err := savePacket(e)
+	if err != nil {
+		return nil, err
+	}
+	es.Kind, es.Packet = packetEventKind, packet
+	return es, nil
+}
+
+// Restore loads a snapshot into an oracle built with NewOracle, with its miners
+// and network set but without calling Prepare. The miners and the network may be
+// configured differently from the checkpointed run, e.g. miner 0 can turn from an
+// honest miner into an attacker, as long as the number of miners is the same.
+func (o *Oracle) Restore(state *OracleState) error {
+	if len(state.Miners) != o.LenMiner() {
+		return fmt.Errorf("checkpoint has %d miners, scenario has %d", len(state.Miners), o.LenMiner())
+	}
+	if err := o.rand.restore(state.Rand); err != nil {
+		return err
+	}
+	o.timestamp = state.Timestamp
+	o.mined = state.Mined
+	o.draining = state.Draining
+
+	o.blocks = make([]*Block, len(state.Blocks))
+	for index, bs := range state.Blocks {
+		block := &Block{
+			index:         index,
+			minerID:       bs.MinerID,
+			residual:      bs.Residual,
+			hash:          o.blockHash(index),
+			heavy:         o.heavyDraw(index),
+			time:          bs.Time,
+			timestamp:     bs.Timestamp,
+			difficulty:    bs.Difficulty,
+			height:        bs.Height,
+			ancestorNum:   bs.AncestorNum,
+			receivingTime: bs.ReceivingTime,
+			receivedNum:   bs.ReceivedNum,
+			receivedSum:   bs.ReceivedSum,
+			minerTime:     bs.MinerTime,
+			lastTime:      bs.LastTime,
+			adaptive:      bs.Adaptive,
+		}
+		if bs.SeenAll {
+			block.seenNum = o.LenMiner()
+		}
+		for _, id := range bs.Seen {
+			block.see(id, o.LenMiner())
+		}
+		o.blocks[index] = block
+	}
+	for index, bs := range state.Blocks {
+		block := o.blocks[index]
+		if bs.Parent >= 0 {
+			block.parent = o.blocks[bs.Parent]
+		}
+		block.references = restoreBlocks(o.blocks, bs.References)
+		block.children = restoreBlocks(o.blocks, bs.Children)
+		block.refChildren = restoreBlocks(o.blocks, bs.RefChildren)
+	}
+
+	for id, miner := range o.miners.miners {
+		stateful, ok := miner.(Stateful)
+		if !ok {
+			return fmt.Errorf("miner %d (%T) can not be restored", id, miner)
+		}
+		if err := stateful.LoadState(state.Miners[id]); err != nil {
+			return fmt.Errorf("miner %d: %v", id, err)
+		}
+	}
+	if o.network != nil {
+		stateful, ok := o.network.(Stateful)
+		if !ok {
+			return fmt.Errorf("network %T can not be restored", o.network)
+		}
+		if err := stateful.LoadState(state.Network); err != nil {
+			return err
+		}
+	}
+
+	queue, err := NewEventQueue(o.options.Queue)
+	if err != nil {
+		return err
+	}
+	o.queue = queue
+	for _, es := range state.Events {
+		event, err := o.restoreEvent(es)
+		if err != nil {
+			return err
+		}
+		event.SetSeq(es.Seq)
+		o.queue.restore(event)
+	}
+	o.queue.nextSeq = state.NextSeq
+
+	if state.TraceHash != nil {
+		traceHash := fnv.New64a()
+		if err := traceHash.(interface{ UnmarshalBinary([]byte) error }).UnmarshalBinary(state.TraceHash); err != nil {
+			return err
+		}
+		o.traceHash = traceHash
+	}
+	return nil
+}
+
+func (o *Oracle) restoreEvent(es *eventState) (Event, error) {
+	base := BaseEvent{timestamp: es.Time}
+	switch es.Kind {
+	case genBlockEventKind:
+		return &GenBlockEvent{BaseEvent: base, block: o.blocks[es.Block]}, nil
+	case sendBlockEventKind:
+		return &SendBlockEvent{BaseEvent: base, block: o.blocks[es.Block], receiverID: es.Receiver}, nil
+	case broadcastEventKind:
+		network, ok := o.network.(*SimpleNetwork)
+		if !ok {
+			return nil, fmt.Errorf("broadcast event needs a simple network, got %T", o.network)
+		}
+		return &BroadcastEvent{BaseEvent: base, block: o.blocks[es.Block], senderID: es.Sender, network: network}, nil
+	case peerSendEventKind:
+		network, ok := o.network.(*PeerNetwork)
+		if !ok {
+			return nil, fmt.Errorf("peer send event needs a peer network, got %T", o.network)
+		}
+		return &PeerSendEvent{BaseEvent: base, block: o.blocks[es.Block], senderID: es.Sender, network: network, first: es.First}, nil
+	case delayInsertEventKind:
+		miner, ok := o.miners.miners[es.Receiver].(*WithholdMiner)
+		if !ok {
+			return nil, fmt.Errorf("delayed insertion for miner %d, which is not a withhold miner", es.Receiver)
+		}
+		return &DelayInsertEvent{BaseEvent: base, block: o.blocks[es.Block], m: miner}, nil
+	case requestTimeoutEventKind:
+		network, ok := o.network.(*BitcoinNetwork)
+		if !ok {
+			return nil, fmt.Errorf("request timeout needs a bitcoin network, got %T", o.network)
+		}
+		event := &RequestTimeoutEvent{BaseEvent: base, network: network, key: requestKey{es.Receiver, es.Block}}
+		if request, ok := network.requests[event.key]; ok {
+			request.timeout = NewCancelToken(event)
+		}
+		return event, nil
+	case wakeupTrafficEventKind, packetEventKind:
+		network, ok := o.network.(*BitcoinNetwork)
+		if !ok {
+			return nil, fmt.Errorf("traffic event needs a bitcoin network, got %T", o.network)
+		}
+		if es.Kind == packetEventKind {
+			embedded, packet := network.restorePacket(es.Packet)
+			if es.Packet.Embedded {
+				return embedded, nil
+			}
+			return packet, nil
+		}
+		sender, ok := network.traffic.nodes[es.Sender]
+		if !ok {
+			return nil, fmt.Errorf("wakeup event of unknown node %d", es.Sender)
+		}
+		event := &WakeupTrafficEvent{BaseEvent: base, sender: sender, traffic: network.traffic}
+		// The latest created wakeup event of a node is the pending one.
+		if sender.nextWakeupE == nil || sender.nextWakeupE.GetSeq() < es.Seq {
+			sender.nextWakeupE = event
+		}
+		return event, nil
+	}
+	return nil, fmt.Errorf("unknown event kind %d in the checkpoint", es.Kind)
+}
+
+type checkpointFile struct {
+	Version  int
+	Scenario string // The scenario in JSON
+	State    *OracleState
+}
+
+// Checkpoint is the content of a checkpoint file.
+type Checkpoint struct {
+	Config *Config
+	State  *OracleState
+}
+
+// WriteCheckpoint writes the scenario and the state of a run to w.
+func WriteCheckpoint(w io.Writer, cfg *Config, o *Oracle) error {
+	state, err := o.State()
+	if err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(&checkpointFile{Version: checkpointVersion, Scenario: cfg.String(), State: state})
+}
+
+func ReadCheckpoint(r io.Reader) (*Checkpoint, error) {
+	var file checkpointFile
+	if err := gob.NewDecoder(r).Decode(&file); err != nil {
+		return nil, fmt.Errorf("read checkpoint: %v", err)
+	}
+	if file.Version != checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", file.Version)
+	}
+	cfg := DefaultConfig()
+	if err := json.Unmarshal([]byte(file.Scenario), cfg); err != nil {
+		return nil, fmt.Errorf("scenario of the checkpoint: %v", err)
+	}
+	return &Checkpoint{Config: cfg, State: file.State}, nil
+}
+
+type checkpointTrigger struct {
+	every     int64 // Time slots between two checkpoints, 0 to disable
+	next      int64
+	requested atomic.Bool
+	save      func(*Oracle) error
+}
+
+// EnableCheckpoint makes the oracle call save every `every` seconds of simulated
+// time (never if it is 0) and after each RequestCheckpoint.
+func (o *Oracle) EnableCheckpoint(every float64, save func(*Oracle) error) {
+	trigger := &checkpointTrigger{every: int64(every * o.timePrecision), save: save}
+	if trigger.every > 0 {
+		trigger.next = (o.timestamp/trigger.every + 1) * trigger.every
+	}
+	o.checkpoint = trigger
+}
+
+// RequestCheckpoint asks for a checkpoint after the current event. It is safe to
+// call it from another goroutine, e.g. a signal handler.
+func (o *Oracle) RequestCheckpoint() {
+	if o.checkpoint != nil {
+		o.checkpoint.requested.Store(true)
+	}
+}
+
+func (o *Oracle) checkCheckpoint() {
+	trigger := o.checkpoint
+	due := trigger.requested.Swap(false)
+	if trigger.every > 0 && o.timestamp >= trigger.next {
+		due = true
+		for trigger.next <= o.timestamp {
+			trigger.next += trigger.every
+		}
+	}
+	if !due {
+		return
+	}
+	if err := trigger.save(o); err != nil {
+		log.Errorf("Checkpoint at %.2f s failed: %v", o.RealTime(), err)
+	} else {
+		log.Warningf("Checkpoint at %.2f s", o.RealTime())
+	}
+}
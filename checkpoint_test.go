@@ -0,0 +1,49 @@
+package simulator
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestResumeAsWithholdMiner resumes the checkpoint of an honest run with miner 0
+// turned into a withholding attacker. The attacker restores the view of an honest
+// miner, whose deliveries may arrive before their parents.
+func TestResumeAsWithholdMiner(t *testing.T) {
+	for _, network := range []string{"simple", "bitcoin"} {
+		cfg := testConfig(3)
+		cfg.Network.Type = network
+		var file strings.Builder
+		runOracle(t, cfg, func(cfg *Config) (*Oracle, error) {
+			oracle, err := NewScenario(cfg)
+			if err != nil {
+				return nil, err
+			}
+			oracle.EnableCheckpoint(cfg.Duration/2, func(o *Oracle) error {
+				if file.Len() > 0 {
+					return nil
+				}
+				return WriteCheckpoint(&file, cfg, o)
+			})
+			return oracle, nil
+		}, nil)
+
+		for _, strategy := range []string{"withhold", "withhold:delayRef", "withhold:selfish"} {
+			checkpoint, err := ReadCheckpoint(strings.NewReader(file.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resumed := checkpoint.Config
+			resumed.Duration *= 2
+			resumed.Miners.Honest--
+			resumed.Attacker.Enabled = true
+			resumed.Attacker.Ratio = 0.3
+			resumed.Attacker.Strategy = strategy
+			oracle := runOracle(t, resumed, func(cfg *Config) (*Oracle, error) {
+				return ResumeScenario(cfg, checkpoint.State)
+			}, nil)
+			if oracle.RealTime() < resumed.Duration {
+				t.Errorf("%s, %s: the resumed run stopped at %.2f s", network, strategy, oracle.RealTime())
+			}
+		}
+	}
+}
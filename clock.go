@@ -0,0 +1,138 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ClockConfig gives each node a clock of its own and the rules the honest miners
+// apply to the timestamps of the blocks. The zero value keeps every clock on the
+// time of the oracle and accepts any timestamp.
+type ClockConfig struct {
+	Offset float64 `json:"offset,omitempty"` // Standard deviation of the clock offsets (s)
+	Drift  float64 `json:"drift,omitempty"`  // Standard deviation of the clock drifts (ppm)
+
+	MedianPast int     `json:"medianPast,omitempty"` // A timestamp must be above the median of this many ancestors, 0 to disable
+	MaxFuture  float64 `json:"maxFuture,omitempty"`  // A timestamp may be ahead of the local clock by this many seconds, 0 to disable
+}
+
+func (c ClockConfig) validate() error {
+	if c.Offset < 0 || c.Drift < 0 || c.MedianPast < 0 || c.MaxFuture < 0 {
+		return fmt.Errorf("clock parameters must not be negative")
+	}
+	if c.Drift >= 1e5 {
+		return fmt.Errorf("clock drift of %g ppm is too large", c.Drift)
+	}
+	return nil
+}
+
+// nodeClock reads offset + (1 + drift) * t at time slot t of the oracle.
+type nodeClock struct {
+	offset int64
+	drift  float64
+}
+
+// setupClocks draws the clock of every miner from the clock stream. Clocks are
+// only drawn if they are enabled, so the other streams are not affected.
+func (o *Oracle) setupClocks() {
+	c := o.options.Clock
+	if c.Offset == 0 && c.Drift == 0 {
+		return
+	}
+	o.clocks = make([]nodeClock, o.LenMiner())
+	for id := range o.clocks {
+		o.clocks[id] = nodeClock{
+			offset: int64(o.rand.Clock.NormFloat64() * c.Offset * o.timePrecision),
+			drift:  o.rand.Clock.NormFloat64() * c.Drift * 1e-6,
+		}
+	}
+}
+
+// LocalTime returns the time slot shown by the clock of a node, -1 for the oracle.
+func (o *Oracle) LocalTime(node int) int64 {
+	if node < 0 {
+		return o.timestamp
+	}
+	now := o.now(node)
+	if o.clocks == nil {
+		return now
+	}
+	clock := o.clocks[node]
+	return now + clock.offset + int64(clock.drift*float64(now))
+}
+
+// untilLocalTime returns the first time slot of the oracle at which the clock of
+// the node shows local.
+func (o *Oracle) untilLocalTime(node int, local int64) int64 {
+	if o.clocks == nil || node < 0 {
+		return local
+	}
+	clock := o.clocks[node]
+	return int64(math.Ceil(float64(local-clock.offset) / (1 + clock.drift)))
+}
+
+// clockRules are the timestamp rules of the scenario, applied by a miner to the
+// blocks it inserts in its fork choice.
+type clockRules struct {
+	medianPast int
+	maxFuture  int64
+	clock      func() int64 // Local time of the miner
+}
+
+// newClockRules returns the timestamp rules of the scenario for a miner.
+func (o *Oracle) newClockRules(miner int) *clockRules {
+	return &clockRules{
+		medianPast: o.options.Clock.MedianPast,
+		maxFuture:  int64(o.options.Clock.MaxFuture * o.timePrecision),
+		clock: func() int64 {
+			return o.LocalTime(miner)
+		},
+	}
+}
+
+// medianTime returns the median timestamp of block and its ancestors, up to
+// medianPast blocks.
+func (r *clockRules) medianTime(block *Block) int64 {
+	var times []int64
+	for ; block != nil && len(times) < r.medianPast; block = block.parent {
+		times = append(times, block.timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i] < times[j]
+	})
+	return times[len(times)/2]
+}
+
+// insert inserts a block in a fork choice if the rules accept its timestamp. The
+// rules are applied once the ancestors of the block are in the fork choice, the
+// genesis block is always valid.
+func (r *clockRules) insert(g ForkChoice, block *Block) InsertResult {
+	if r.medianPast == 0 && r.maxFuture == 0 || block.parent == nil || g.Contains(block) || !containsAncestors(g, block) {
+		return g.Insert(block)
+	}
+	if r.medianPast > 0 && block.timestamp <= r.medianTime(block.parent) {
+		return Invalid
+	}
+	if r.maxFuture > 0 && block.timestamp > r.clock()+r.maxFuture {
+		return Future
+	}
+	return g.Insert(block)
+}
+
+// stamp raises the timestamp of a new block above the median of its ancestors,
+// as a miner of Bitcoin does, so the block is valid even if the clock of the
+// miner is behind.
+func (r *clockRules) stamp(block *Block) {
+	if r.medianPast > 0 {
+		block.timestamp = max(block.timestamp, r.medianTime(block.parent)+1)
+	}
+}
+
+// deferBlock delivers a block too far in the future to the miner again when its
+// clock allows it.
+func (o *Oracle) deferBlock(block *Block, miner int, maxFuture int64) Event {
+	at := max(o.untilLocalTime(miner, block.timestamp-maxFuture), o.now(miner)+1)
+	log.Infof("Time %.2f, Miner %d defers block %d to %.2f", o.realTimeAt(miner), miner, block.index, float64(at)/o.timePrecision)
+	return NewSendBlockEvent(at, block, miner)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	simulator "github.com/Conflux-Chain/conflux-simulator"
+	"github.com/Conflux-Chain/conflux-simulator/go-logging"
+)
+
+// eventCounter counts the executed events and the largest queue.
+type eventCounter struct {
+	simulator.BaseObserver
+	events  int
+	maxSize int
+}
+
+func (c *eventCounter) AfterEvent(o *simulator.Oracle, event simulator.Event, results []simulator.Event) {
+	c.events++
+	if size := o.QueueLen(); size > c.maxSize {
+		c.maxSize = size
+	}
+}
+
+type benchResult struct {
+	queue   string
+	events  int
+	maxSize int
+	elapsed time.Duration
+	hash    uint64
+}
+
+func benchRun(cfg *simulator.Config) (*benchResult, error) {
+	oracle, err := simulator.NewScenario(cfg)
+	if err != nil {
+		return nil, err
+	}
+	oracle.EnableTraceHash()
+	counter := &eventCounter{}
+	oracle.AddObserver(counter)
+
+	start := time.Now()
+	oracle.Run()
+	return &benchResult{
+		queue:   cfg.Queue,
+		events:  counter.events,
+		maxSize: counter.maxSize,
+		elapsed: time.Since(start),
+		hash:    oracle.TraceHash(),
+	}, nil
+}
+
+// benchMain runs the same scenario with each event queue, reports the events
+// per second and checks that the runs are identical.
+func benchMain(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [flags] [scenario file]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var params sweepParams
+	queues := fs.String("queues", strings.Join(simulator.QueueKinds, ","), "Event queues to compare")
+	fs.Var(&params, "p", "Parameter `name=value` of the scenario (repeatable), as for sweep")
+	duration := fs.Float64("t", 20, "Duration (in blocks)")
+	seed := fs.Int64("seed", 1, "Random seed")
+	repeat := fs.Int("repeat", 1, "Runs of each queue, the fastest is reported")
+	logLevel := fs.Int("log", 1, "Log Level of the runs (1E,2W,3N,4I,5D)")
+	fs.Parse(args)
+
+	simulator.LoadLogger(logging.Level(*logLevel))
+
+	cfg := simulator.DefaultConfig()
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	if fs.NArg() == 1 {
+		if err := cfg.Load(fs.Arg(0)); err != nil {
+			log.Error(err)
+			return 2
+		}
+	}
+	cfg.Duration = *duration
+	cfg.Seed = *seed
+	cfg.LogLevel = *logLevel
+	for _, param := range params {
+		if len(param.values) != 1 {
+			log.Errorf("-p %s: expect a single value", param.name)
+			return 2
+		}
+		if err := cfg.Set(param.path, param.values[0]); err != nil {
+			log.Error(err)
+			return 2
+		}
+	}
+
+	var results []*benchResult
+	for _, queue := range strings.Split(*queues, ",") {
+		var best *benchResult
+		for i := 0; i < *repeat; i++ {
+			run := cfg.Clone()
+			run.Queue = queue
+			result, err := benchRun(run)
+			if err != nil {
+				log.Error(err)
+				return 2
+			}
+			if best == nil || result.elapsed < best.elapsed {
+				best = result
+			}
+		}
+		results = append(results, best)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "queue\tevents\tmax queued\tseconds\tevents/s\ttrace hash\t\n")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\t%.0f\t%016x\t\n", r.queue, r.events, r.maxSize, r.elapsed.Seconds(), float64(r.events)/r.elapsed.Seconds(), r.hash)
+	}
+	w.Flush()
+
+	for _, r := range results[1:] {
+		if r.hash != results[0].hash {
+			log.Errorf("Queue %s executed other events than queue %s", r.queue, results[0].queue)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	simulator "github.com/Conflux-Chain/conflux-simulator"
+)
+
+const (
+	progressInterval = time.Second // Wall time between two progress points
+	progressHistory  = 1000        // Points kept per run, older ones are thinned out
+	metricsInterval  = 50          // Mined blocks between two computations of the metrics
+)
+
+// progressPoint is the state of a run at some wall time.
+type progressPoint struct {
+	Wall        float64 `json:"wall"`    // Seconds since the run started
+	SimTime     float64 `json:"simTime"` // Simulated seconds
+	Events      int64   `json:"events"`
+	EventRate   float64 `json:"eventRate"` // Events per second since the previous point
+	Queue       int     `json:"queue"`
+	Mined       int     `json:"mined"`
+	PivotHeight int     `json:"pivotHeight"` // -1 if the observer has no local graph
+	Antiset     float64 `json:"antiset"`     // Latest metrics of the observer
+	EpochSize   float64 `json:"epochSize"`
+}
+
+type runProgress struct {
+	Name    string             `json:"name"`
+	State   string             `json:"state"` // running, done or failed
+	Error   string             `json:"error,omitempty"`
+	Latest  progressPoint      `json:"latest"`
+	Metrics *simulator.Metrics `json:"metrics,omitempty"`
+	History []progressPoint    `json:"history"`
+
+	every int // History keeps one point every `every` intervals
+	skip  int
+}
+
+// dashboard serves the progress of the runs of this process over HTTP: a JSON
+// document at /progress.json and a page with charts at /.
+type dashboard struct {
+	mu    sync.Mutex
+	start time.Time
+	runs  []*runProgress
+}
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+var dashboard_ *dashboard // nil if -http is not given
+
+// serveDashboard listens on addr and serves the dashboard in the background.
+func serveDashboard(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	d := &dashboard{start: time.Now()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	mux.HandleFunc("/progress.json", d.serveProgress)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("Dashboard: %v", err)
+		}
+	}()
+	log.Errorf("Dashboard on http://%s/", listener.Addr())
+	dashboard_ = d
+	return nil
+}
+
+func (d *dashboard) serveProgress(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	content, err := json.Marshal(struct {
+		Uptime float64        `json:"uptime"`
+		Runs   []*runProgress `json:"runs"`
+	}{time.Since(d.start).Seconds(), d.runs})
+	d.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(content)
+}
+
+// add registers a run on the dashboard. The methods of the dashboard are
+// nil-safe, so the runs do not check whether -http is given.
+func (d *dashboard) add(name string) *runProgress {
+	if d == nil {
+		return nil
+	}
+	run := &runProgress{Name: name, State: "running", every: 1}
+	d.mu.Lock()
+	d.runs = append(d.runs, run)
+	d.mu.Unlock()
+	return run
+}
+
+// watch attaches a progress observer to the oracle of a run.
+func (d *dashboard) watch(run *runProgress, oracle *simulator.Oracle) {
+	if d == nil {
+		return
+	}
+	oracle.AddObserver(&progressObserver{dashboard: d, run: run, start: time.Now()})
+}
+
+// finish records the end of a run, err is nil if it succeeded.
+func (d *dashboard) finish(run *runProgress, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		run.State, run.Error = "failed", err.Error()
+	} else {
+		run.State = "done"
+	}
+}
+
+func (d *dashboard) record(run *runProgress, point progressPoint, metrics *simulator.Metrics) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	run.Latest = point
+	if metrics != nil {
+		run.Metrics = metrics
+	}
+	run.skip++
+	if run.skip < run.every {
+		return
+	}
+	run.skip = 0
+	run.History = append(run.History, point)
+	if len(run.History) >= progressHistory {
+		// Keep every other point, and record half as often from now on.
+		for i := 0; i < len(run.History)/2; i++ {
+			run.History[i] = run.History[2*i+1]
+		}
+		run.History = run.History[:len(run.History)/2]
+		run.every *= 2
+	}
+}
+
+// progressObserver samples a run for the dashboard. It reads the wall clock every
+// few events only, and computes the metrics of the observer every
+// metricsInterval mined blocks, as the periodic reports do.
+type progressObserver struct {
+	simulator.BaseObserver
+	dashboard *dashboard
+	run       *runProgress
+	start     time.Time
+
+	events     int64
+	lastEvents int64
+	lastWall   time.Time
+	antiset    float64
+	epochSize  float64
+	metrics    *simulator.Metrics // Computed since the last point
+}
+
+func (p *progressObserver) AfterEvent(o *simulator.Oracle, event simulator.Event, results []simulator.Event) {
+	p.events++
+	if p.events%256 != 0 {
+		return
+	}
+	if now := time.Now(); now.Sub(p.lastWall) >= progressInterval {
+		p.sample(o, now)
+	}
+}
+
+func (p *progressObserver) BlockMined(o *simulator.Oracle, block *simulator.Block) {
+	if o.MinedBlocks()%metricsInterval != 0 {
+		return
+	}
+	metrics, err := o.Metrics()
+	if err != nil {
+		return
+	}
+	p.antiset, p.epochSize = metrics.Antiset, metrics.EpochSize
+	p.metrics = metrics
+}
+
+func (p *progressObserver) SimulationEnd(o *simulator.Oracle) {
+	if metrics, err := o.Metrics(); err == nil {
+		p.antiset, p.epochSize = metrics.Antiset, metrics.EpochSize
+		p.metrics = metrics
+	}
+	p.sample(o, time.Now())
+}
+
+func (p *progressObserver) sample(o *simulator.Oracle, now time.Time) {
+	point := progressPoint{
+		Wall:        now.Sub(p.start).Seconds(),
+		SimTime:     o.RealTime(),
+		Events:      p.events,
+		Queue:       o.QueueLen(),
+		Mined:       o.MinedBlocks(),
+		PivotHeight: o.PivotHeight(),
+		Antiset:     p.antiset,
+		EpochSize:   p.epochSize,
+	}
+	if !p.lastWall.IsZero() {
+		point.EventRate = float64(p.events-p.lastEvents) / now.Sub(p.lastWall).Seconds()
+	} else if point.Wall > 0 {
+		point.EventRate = float64(p.events) / point.Wall
+	}
+	p.lastEvents, p.lastWall = p.events, now
+	p.dashboard.record(p.run, point, p.metrics)
+	p.metrics = nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	simulator "github.com/Conflux-Chain/conflux-simulator"
+	"github.com/Conflux-Chain/conflux-simulator/go-logging"
+)
+
+var log = logging.MustGetLogger("main")
+
+var (
+	verifyDeterminism_ bool
+	recordPath_        string
+	replayPath_        string
+	checkpointPath_    string
+	checkpointEvery_   float64
+	summaryPath_       string
+	replicas_          int
+	workers_           int
+	httpAddr_          string
+	resumeState_       *simulator.OracleState
+)
+
+// openTrace opens a trace file for reading, gzip compressed if its name ends with ".gz".
+func openTrace(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, file}, nil
+}
+
+type traceFile struct {
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func createTrace(path string) (*traceFile, io.Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	tf := &traceFile{file: file}
+	if strings.HasSuffix(path, ".gz") {
+		tf.gz = gzip.NewWriter(file)
+		return tf, tf.gz, nil
+	}
+	return tf, file, nil
+}
+
+func (tf *traceFile) Close() error {
+	if tf.gz != nil {
+		if err := tf.gz.Close(); err != nil {
+			tf.file.Close()
+			return err
+		}
+	}
+	return tf.file.Close()
+}
+
+// saveCheckpoint replaces the checkpoint file only after the new one is complete.
+func saveCheckpoint(cfg *simulator.Config, oracle *simulator.Oracle) error {
+	tmp := checkpointPath_ + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := simulator.WriteCheckpoint(writer, cfg, oracle); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, checkpointPath_)
+}
+
+func loadCheckpoint(path string) (*simulator.Checkpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return simulator.ReadCheckpoint(bufio.NewReader(file))
+}
+
+func run(cfg *simulator.Config, traceHash bool) *simulator.Oracle {
+	var oracle *simulator.Oracle
+	var err error
+	if resumeState_ != nil {
+		oracle, err = simulator.ResumeScenario(cfg, resumeState_)
+	} else if replayPath_ != "" {
+		var trace io.ReadCloser
+		if trace, err = openTrace(replayPath_); err != nil {
+			log.Fatal(err)
+		}
+		defer trace.Close()
+		oracle, err = simulator.NewReplayScenario(cfg, trace)
+	} else {
+		oracle, err = simulator.NewScenario(cfg)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if traceHash {
+		oracle.EnableTraceHash()
+	}
+	progress := dashboard_.add("run")
+	dashboard_.watch(progress, oracle)
+	defer dashboard_.finish(progress, nil)
+
+	if checkpointPath_ != "" {
+		oracle.EnableCheckpoint(checkpointEvery_, func(o *simulator.Oracle) error {
+			return saveCheckpoint(cfg, o)
+		})
+		stop := notifyCheckpoint(oracle.RequestCheckpoint)
+		defer stop()
+	}
+
+	var record *traceFile
+	if recordPath_ != "" {
+		var w io.Writer
+		record, w, err = createTrace(recordPath_)
+		if err != nil {
+			log.Fatal(err)
+		}
+		oracle.RecordTrace(w)
+	}
+
+	oracle.Run()
+
+	if record != nil {
+		if err := oracle.FlushTrace(); err != nil {
+			log.Fatal(err)
+		}
+		if err := record.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if replayPath_ != "" {
+		blocks, diverged := oracle.ReplaySummary()
+		log.Warningf("Replayed %d blocks, %d of them chose different edges than in the trace", blocks, diverged)
+	}
+	return oracle
+}
+
+func flagParse() (*simulator.Config, error) {
+	cfg := simulator.DefaultConfig()
+	scenario := flag.String("c", "", "Scenario file (JSON), other flags override its fields")
+	list := flag.Bool("list", false, "List the available networks and miners")
+	flag.BoolVar(&verifyDeterminism_, "verify-determinism", false, "Run the scenario twice and compare the hash of the executed events")
+	flag.StringVar(&recordPath_, "record", "", "Record the block events to a trace file (gzip if it ends with .gz)")
+	flag.StringVar(&replayPath_, "replay", "", "Drive the miners by a trace file instead of simulating the network")
+	flag.StringVar(&checkpointPath_, "checkpoint", "", "Checkpoint file, written periodically (-checkpoint-every) and on SIGUSR1")
+	flag.Float64Var(&checkpointEvery_, "checkpoint-every", 0, "Simulated seconds between two checkpoints (0 for on demand only)")
+	flag.StringVar(&summaryPath_, "summary", "", "Write the metrics of the run to a JSON file")
+	flag.StringVar(&httpAddr_, "http", "", "Serve a live progress dashboard on this address, e.g. :8080")
+	flag.IntVar(&replicas_, "replicas", 1, "Run the scenario with this many derived seeds and report mean, std and 95% CI of the metrics")
+	flag.IntVar(&workers_, "workers", runtime.NumCPU(), "Number of replicas run in parallel with -replicas")
+	resume := flag.String("resume", "", "Resume a checkpoint, its scenario is overridden by -c and the other flags")
+
+	flag.BoolVar(&cfg.Debug, "d", cfg.Debug, "Set debug")
+	flag.Int64Var(&cfg.Seed, "seed", cfg.Seed, "Random seed (0 for a time based seed)")
+	flag.IntVar(&cfg.LogLevel, "log", cfg.LogLevel, "Log Level (1E,2W,3N,4I,5D)")
+
+	flag.Float64Var(&cfg.Rate, "r", cfg.Rate, "Block Generation Rate (s/block)")
+	flag.Float64Var(&cfg.BlockSize, "s", cfg.BlockSize, "Block Size (MB)")
+	flag.Float64Var(&cfg.Duration, "t", cfg.Duration, "Duration (in blocks)")
+	flag.StringVar(&cfg.Queue, "queue", cfg.Queue, "Event queue, heap or calendar; both give the same runs")
+	flag.IntVar(&cfg.Parallel, "parallel", cfg.Parallel, "Goroutines running the events of the bitcoin network, 0 for the sequential engine; both give the same runs")
+	flag.StringVar(&cfg.Stop, "stop", cfg.Stop, "Stop condition replacing -t, e.g. blocks:1000 or height:500&wall:10m (see -list)")
+	flag.StringVar(&cfg.Difficulty, "difficulty", cfg.Difficulty, "Difficulty adjuster, e.g. bitcoin:window=100 or ema (see -list)")
+	flag.Float64Var(&cfg.Risk, "risk", cfg.Risk, "Check the confirmation risks against this adversary share with the pivot reversions of the run, 0 to disable")
+	flag.StringVar(&cfg.ForkChoice, "forkchoice", cfg.ForkChoice, "Fork choice, ghost or ghast:beta=1000,heavy=240 (see -list)")
+	flag.StringVar(&cfg.TieBreak, "tiebreak", cfg.TieBreak, "Fork choice between subtrees of the same weight: residual, hash, first-seen or random")
+	flag.IntVar(&cfg.Miners.Honest, "n", cfg.Miners.Honest, "Number of honest miners")
+
+	flag.StringVar(&cfg.Network.Type, "net", cfg.Network.Type, "Network spec, e.g. bitcoin or simple:honestDelay=10 (see -list)")
+	flag.Float64Var(&cfg.Network.Bandwidth, "band", cfg.Network.Bandwidth, "Bandwidth(Mbps)")
+	flag.Float64Var(&cfg.Network.BufferSize, "buff", cfg.Network.BufferSize, "Buffer Size (MB)")
+	flag.Float64Var(&cfg.Network.LocalRatio, "local", cfg.Network.LocalRatio, "Local ratio")
+	flag.IntVar(&cfg.Network.Peers, "peer", cfg.Network.Peers, "Number of peers")
+
+	flag.BoolVar(&cfg.Attacker.Enabled, "a", cfg.Attacker.Enabled, "Attacker")
+	flag.BoolVar(&cfg.Attacker.Monopoly, "m", cfg.Attacker.Monopoly, "Special Honest Miner")
+	flag.Float64Var(&cfg.Attacker.Ratio, "l", cfg.Attacker.Ratio, "Attacker ratio")
+	flag.StringVar(&cfg.Attacker.Strategy, "attacker", cfg.Attacker.Strategy, "Miner spec of the attacker, e.g. withhold:delayRef (see -list)")
+	flag.StringVar(&cfg.Miners.Type, "honest", cfg.Miners.Type, "Miner spec of honest miners (see -list)")
+
+	flag.Parse()
+
+	if *list {
+		simulator.ListComponents(os.Stdout)
+		os.Exit(0)
+	}
+
+	// Flags given on the command line take precedence over the scenario file.
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		overrides[f.Name] = f.Value.String()
+	})
+	if *resume != "" {
+		checkpoint, err := loadCheckpoint(*resume)
+		if err != nil {
+			return nil, err
+		}
+		*cfg = *checkpoint.Config
+		resumeState_ = checkpoint.State
+	} else if *scenario != "" {
+		*cfg = *simulator.DefaultConfig()
+	}
+	if *scenario != "" {
+		if err := cfg.Load(*scenario); err != nil {
+			return nil, err
+		}
+	}
+	if *resume != "" || *scenario != "" {
+		for name, value := range overrides {
+			flag.Set(name, value)
+		}
+	}
+
+	if cfg.Seed == 0 {
+		if cfg.Debug {
+			cfg.Seed = int64(499226315)
+		} else {
+			cfg.Seed = int64(time.Now().Nanosecond())
+		}
+	}
+	if !cfg.Attacker.Enabled && !cfg.Attacker.Monopoly {
+		cfg.Attacker.Ratio = 0
+	}
+	if workers_ < 1 {
+		return nil, fmt.Errorf("-workers must be at least 1")
+	}
+	if replicas_ > 1 && (verifyDeterminism_ || recordPath_ != "" || replayPath_ != "" || checkpointPath_ != "" || *resume != "") {
+		return nil, fmt.Errorf("-replicas can not be combined with -verify-determinism, -record, -replay, -checkpoint or -resume")
+	}
+	if cfg.Parallel > 0 && (recordPath_ != "" || replayPath_ != "" || checkpointPath_ != "" || *resume != "") {
+		return nil, fmt.Errorf("-parallel can not be combined with -record, -replay, -checkpoint or -resume")
+	}
+	return cfg, cfg.Validate()
+}
+
+// writeSummary writes the metrics of a finished run.
+func writeSummary(oracle *simulator.Oracle) error {
+	metrics, err := oracle.Metrics()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(summaryPath_, content, 0644)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sweep" {
+		os.Exit(sweepMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(benchMain(os.Args[2:]))
+	}
+
+	cfg, err := flagParse()
+	if err != nil {
+		simulator.LoadLogger(logging.ERROR)
+		log.Error(err)
+		os.Exit(2)
+	}
+	simulator.LoadLogger(logging.Level(cfg.LogLevel))
+	if httpAddr_ != "" {
+		if err := serveDashboard(httpAddr_); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Warningf("[Running parameters]")
+	if !cfg.Attacker.Enabled && cfg.Attacker.Monopoly {
+		log.Warningf("Basic: rate %0.1f, size %0.0f MB, special honest miner %0.0f%%", cfg.Rate, cfg.BlockSize, cfg.Attacker.Ratio*100)
+	} else {
+		log.Warningf("Basic: rate %0.1f, size %0.0f MB, attacker %0.0f%%", cfg.Rate, cfg.BlockSize, cfg.Attacker.Ratio*100)
+	}
+	log.Warningf("Network: bandwidth %0.1f Mbps, %0.1f buffer, %d peers, %d neighbors, local ratio %0.2f", cfg.Network.Bandwidth, cfg.Network.BufferSize, cfg.Miners.Honest, cfg.Network.Peers, cfg.Network.LocalRatio)
+	log.Warningf("Scenario: %s", cfg)
+
+	log.Noticef("Random seed for this run: %d", cfg.Seed)
+
+	log.Error("Start")
+	if verifyDeterminism_ {
+		first := run(cfg, true).TraceHash()
+		log.Error("Second run")
+		second := run(cfg, true).TraceHash()
+		if first != second {
+			log.Errorf("Runs are not deterministic: trace hash %016x != %016x", first, second)
+			os.Exit(1)
+		}
+		log.Errorf("Runs are deterministic: trace hash %016x", first)
+	} else if replicas_ > 1 {
+		if err := runReplicas(cfg, replicas_, workers_); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		oracle := run(cfg, false)
+		if summaryPath_ != "" {
+			if err := writeSummary(oracle); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	log.Error("done")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	simulator "github.com/Conflux-Chain/conflux-simulator"
+)
+
+type replicaSummary struct {
+	Seed     int64                     `json:"seed"` // Master seed of the replicas
+	Replicas []*simulator.Replica      `json:"replicas"`
+	Stats    map[string]simulator.Stat `json:"stats"`
+}
+
+// runReplicas runs the scenario with n seeds derived from its seed, workers at a
+// time, and reports the statistics of every metric over the replicas.
+func runReplicas(cfg *simulator.Config, n int, workers int) error {
+	replicas := make([]*simulator.Replica, n)
+	errs := make([]error, n)
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				replicaCfg := cfg.Clone()
+				replicaCfg.Seed = simulator.ReplicaSeed(cfg.Seed, i)
+				metrics, err := runPoint(fmt.Sprintf("replica %d", i), replicaCfg)
+				replicas[i] = &simulator.Replica{Seed: replicaCfg.Seed, Metrics: metrics}
+				errs[i] = err
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("replica %d (seed %d): %v", i, replicas[i].Seed, err)
+		}
+	}
+
+	log.Errorf("[%d replicas]", n)
+	log.Errorf("%-8s %-20s %s", "replica", "seed", strings.Join(simulator.MetricNames, " "))
+	for i, replica := range replicas {
+		values := make([]string, len(simulator.MetricNames))
+		for idx, value := range replica.Metrics.Values() {
+			values[idx] = fmt.Sprintf("%.4g", value)
+		}
+		log.Errorf("%-8d %-20d %s", i, replica.Seed, strings.Join(values, " "))
+	}
+
+	summary := &replicaSummary{Seed: cfg.Seed, Replicas: replicas, Stats: make(map[string]simulator.Stat)}
+	log.Errorf("%-20s %12s %12s %27s", "metric", "mean", "std", "95% CI")
+	for idx, stat := range simulator.SummarizeReplicas(replicas) {
+		name := simulator.MetricNames[idx]
+		summary.Stats[name] = stat
+		log.Errorf("%-20s %12.4f %12.4f [%12.4f, %12.4f]", name, stat.Mean, stat.Std, stat.Low, stat.High)
+	}
+
+	if summaryPath_ != "" {
+		content, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(summaryPath_, content, 0644)
+	}
+	return nil
+}
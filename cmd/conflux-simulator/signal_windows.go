@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+// notifyCheckpoint does nothing, there is no SIGUSR1 on Windows.
+func notifyCheckpoint(request func()) (stop func()) {
+	return func() {}
+}
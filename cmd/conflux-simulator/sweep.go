@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	simulator "github.com/Conflux-Chain/conflux-simulator"
+	"github.com/Conflux-Chain/conflux-simulator/go-logging"
+)
+
+// flagPaths maps the flags of a single run to the fields of the scenario, so a
+// sweep can use the same names.
+var flagPaths = map[string]string{
+	"d":          "debug",
+	"r":          "rate",
+	"s":          "blockSize",
+	"t":          "duration",
+	"n":          "miners.honest",
+	"honest":     "miners.type",
+	"net":        "network.type",
+	"band":       "network.bandwidth",
+	"buff":       "network.bufferSize",
+	"local":      "network.localRatio",
+	"peer":       "network.peers",
+	"a":          "attacker.enabled",
+	"m":          "attacker.monopoly",
+	"l":          "attacker.ratio",
+	"attacker":   "attacker.strategy",
+	"queue":      "queue",
+	"parallel":   "parallel",
+	"difficulty": "difficulty",
+	"forkchoice": "forkChoice",
+	"tiebreak":   "tieBreak",
+	"risk":       "risk",
+}
+
+type sweepParam struct {
+	name   string // As given on the command line, used as the column name
+	path   string
+	values []string
+}
+
+type sweepParams []*sweepParam
+
+func (p *sweepParams) String() string {
+	return ""
+}
+
+func (p *sweepParams) Set(value string) error {
+	name, list, ok := strings.Cut(value, "=")
+	if !ok || list == "" {
+		return fmt.Errorf("expect name=v1,v2,..., got %q", value)
+	}
+	path, ok := flagPaths[name]
+	if !ok {
+		path = name
+	}
+	*p = append(*p, &sweepParam{name: name, path: path, values: strings.Split(list, ",")})
+	return nil
+}
+
+// parseSeeds accepts a comma separated list of seeds and ranges, e.g. "1-10,42".
+func parseSeeds(value string) ([]int64, error) {
+	var seeds []int64
+	for _, item := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("seed %q: %v", item, err)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.ParseInt(last, 10, 64); err != nil {
+				return nil, fmt.Errorf("seed %q: %v", item, err)
+			}
+		}
+		for seed := from; seed <= to; seed++ {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds, nil
+}
+
+type sweepPoint struct {
+	scenario string
+	values   []string
+	seed     int64
+	cfg      *simulator.Config
+}
+
+// keys returns the columns which identify the point.
+func (p *sweepPoint) keys(withScenario bool) []string {
+	keys := make([]string, 0, len(p.values)+2)
+	if withScenario {
+		keys = append(keys, p.scenario)
+	}
+	keys = append(keys, p.values...)
+	return append(keys, strconv.FormatInt(p.seed, 10))
+}
+
+// sweepTable is the output of a sweep, one row per finished point.
+type sweepTable struct {
+	file    *os.File
+	writer  *bufio.Writer
+	jsonl   bool
+	columns []string
+	nKeys   int
+	done    map[string]bool
+	mu      sync.Mutex
+}
+
+func openSweepTable(path string, keyColumns []string) (*sweepTable, error) {
+	columns := append(append([]string{}, keyColumns...), simulator.MetricNames...)
+	ext := filepath.Ext(path)
+	t := &sweepTable{
+		jsonl:   ext == ".json" || ext == ".jsonl",
+		columns: columns,
+		nKeys:   len(keyColumns),
+		done:    make(map[string]bool),
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Drop the last row if the previous sweep was killed while writing it.
+	complete := strings.LastIndexByte(string(content), '\n') + 1
+	if err := file.Truncate(int64(complete)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(int64(complete), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	t.file = file
+	t.writer = bufio.NewWriter(file)
+
+	if t.jsonl {
+		err = t.loadJSON(content[:complete])
+	} else {
+		err = t.loadCSV(content[:complete])
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+func (t *sweepTable) loadCSV(content []byte) error {
+	if len(content) == 0 {
+		return t.writeRow(t.columns)
+	}
+	reader := csv.NewReader(strings.NewReader(string(content)))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	if strings.Join(records[0], ",") != strings.Join(t.columns, ",") {
+		return fmt.Errorf("columns %v do not match the sweep %v", records[0], t.columns)
+	}
+	for _, record := range records[1:] {
+		if len(record) == len(t.columns) {
+			t.done[strings.Join(record[:t.nKeys], "\x00")] = true
+		}
+	}
+	return nil
+}
+
+func (t *sweepTable) loadJSON(content []byte) error {
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		row := make(map[string]interface{})
+		if err := decoder.Decode(&row); err != nil {
+			return err
+		}
+		keys := make([]string, t.nKeys)
+		for idx, column := range t.columns[:t.nKeys] {
+			value, ok := row[column]
+			if !ok {
+				return fmt.Errorf("row without column %s", column)
+			}
+			keys[idx] = fmt.Sprint(value)
+		}
+		t.done[strings.Join(keys, "\x00")] = true
+	}
+	return nil
+}
+
+func (t *sweepTable) isDone(keys []string) bool {
+	return t.done[strings.Join(keys, "\x00")]
+}
+
+func (t *sweepTable) writeRow(row []string) error {
+	if t.jsonl {
+		// Keep the order of the columns, values which are not valid JSON (names,
+		// specs, NaN) are written as strings.
+		t.writer.WriteByte('{')
+		for idx, value := range row {
+			if idx > 0 {
+				t.writer.WriteByte(',')
+			}
+			name, _ := json.Marshal(t.columns[idx])
+			t.writer.Write(name)
+			t.writer.WriteByte(':')
+			if !json.Valid([]byte(value)) || t.columns[idx] == "scenario" {
+				quoted, _ := json.Marshal(value)
+				value = string(quoted)
+			}
+			t.writer.WriteString(value)
+		}
+		t.writer.WriteString("}\n")
+	} else {
+		writer := csv.NewWriter(t.writer)
+		writer.Write(row)
+		writer.Flush()
+	}
+	return t.writer.Flush()
+}
+
+func (t *sweepTable) add(keys []string, metrics *simulator.Metrics) error {
+	row := append([]string{}, keys...)
+	for _, value := range metrics.Values() {
+		row = append(row, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeRow(row)
+}
+
+func (t *sweepTable) Close() error {
+	return t.file.Close()
+}
+
+// runPoint runs a scenario in this process, shown on the dashboard by name.
+func runPoint(name string, cfg *simulator.Config) (metrics *simulator.Metrics, err error) {
+	progress := dashboard_.add(name)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		dashboard_.finish(progress, err)
+	}()
+	oracle, err := simulator.NewScenario(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dashboard_.watch(progress, oracle)
+	oracle.Run()
+	return oracle.Metrics()
+}
+
+// runPointSubprocess runs a scenario in a child process, which writes its
+// metrics with -summary.
+func runPointSubprocess(cfg *simulator.Config, logLevel int) (*simulator.Metrics, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "conflux-sweep")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	scenario := filepath.Join(dir, "scenario.json")
+	summary := filepath.Join(dir, "summary.json")
+	if err := os.WriteFile(scenario, []byte(cfg.String()), 0644); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(self, "-c", scenario, "-summary", summary, "-log", strconv.Itoa(logLevel))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return nil, fmt.Errorf("%v: %s", err, lines[len(lines)-1])
+	}
+	content, err := os.ReadFile(summary)
+	if err != nil {
+		return nil, err
+	}
+	metrics := &simulator.Metrics{}
+	if err := json.Unmarshal(content, metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// sweepMain runs a scenario for every combination of the swept parameters and
+// seeds, and collects the metrics into one table.
+func sweepMain(args []string) int {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sweep [flags] [scenario files...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var params sweepParams
+	base := fs.String("c", "", "Base scenario file, also used for the scenario files given as arguments")
+	fs.Var(&params, "p", "Swept parameter `name=v1,v2,...` (repeatable), name is a flag of a single run (r, s, band, l, peer...) or a JSON path like network.params.verifyTime")
+	seedList := fs.String("seeds", "1", "Seeds of each point, e.g. 1-10,42")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of parallel runs")
+	out := fs.String("o", "sweep.csv", "Output table, JSON lines if it ends with .json or .jsonl, CSV otherwise")
+	subprocess := fs.Bool("subprocess", false, "Run each point in a child process, so a crash only fails its own point")
+	logLevel := fs.Int("log", 1, "Log Level of the runs (1E,2W,3N,4I,5D)")
+	httpAddr := fs.String("http", "", "Serve a live progress dashboard on this address, e.g. :8080")
+	fs.Parse(args)
+
+	simulator.LoadLogger(logging.Level(*logLevel))
+	if *httpAddr != "" {
+		if err := serveDashboard(*httpAddr); err != nil {
+			log.Error(err)
+			return 2
+		}
+	}
+
+	seeds, err := parseSeeds(*seedList)
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	scenarios := fs.Args()
+	withScenario := len(scenarios) > 0
+	if !withScenario {
+		scenarios = []string{""}
+	}
+
+	// Build all the points first, so a typo fails before any run.
+	var points []*sweepPoint
+	for _, scenario := range scenarios {
+		cfg := simulator.DefaultConfig()
+		if *base != "" {
+			if err := cfg.Load(*base); err != nil {
+				log.Error(err)
+				return 2
+			}
+		}
+		if scenario != "" {
+			if err := cfg.Load(scenario); err != nil {
+				log.Error(err)
+				return 2
+			}
+		}
+		combinations := [][]string{{}}
+		for _, param := range params {
+			var next [][]string
+			for _, combination := range combinations {
+				for _, value := range param.values {
+					next = append(next, append(append([]string{}, combination...), value))
+				}
+			}
+			combinations = next
+		}
+		for _, values := range combinations {
+			for _, seed := range seeds {
+				point := &sweepPoint{scenario: scenario, values: values, seed: seed, cfg: cfg.Clone()}
+				for idx, param := range params {
+					if err := point.cfg.Set(param.path, values[idx]); err != nil {
+						log.Error(err)
+						return 2
+					}
+				}
+				point.cfg.Seed = seed
+				point.cfg.LogLevel = *logLevel
+				if err := point.cfg.Validate(); err != nil {
+					log.Errorf("%v: %v", point.keys(withScenario), err)
+					return 2
+				}
+				points = append(points, point)
+			}
+		}
+	}
+
+	var keyColumns []string
+	if withScenario {
+		keyColumns = append(keyColumns, "scenario")
+	}
+	for _, param := range params {
+		keyColumns = append(keyColumns, param.name)
+	}
+	keyColumns = append(keyColumns, "seed")
+
+	table, err := openSweepTable(*out, keyColumns)
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	defer table.Close()
+
+	var todo []*sweepPoint
+	for _, point := range points {
+		if !table.isDone(point.keys(withScenario)) {
+			todo = append(todo, point)
+		}
+	}
+	log.Errorf("Sweep: %d points, %d finished already, %d workers", len(points), len(points)-len(todo), *workers)
+
+	queue := make(chan *sweepPoint)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	finished, failed := 0, 0
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for point := range queue {
+				start := time.Now()
+				var metrics *simulator.Metrics
+				var err error
+				keys := point.keys(withScenario)
+				name := strings.Join(keys, " ")
+				if *subprocess {
+					// A child process only shows its state on the dashboard.
+					progress := dashboard_.add(name)
+					metrics, err = runPointSubprocess(point.cfg, *logLevel)
+					dashboard_.finish(progress, err)
+				} else {
+					metrics, err = runPoint(name, point.cfg)
+				}
+				if err == nil {
+					err = table.add(keys, metrics)
+				}
+
+				mu.Lock()
+				finished++
+				if err != nil {
+					failed++
+					log.Errorf("[%d/%d] %v failed: %v", finished, len(todo), keys, err)
+				} else {
+					log.Errorf("[%d/%d] %v done in %.1f s", finished, len(todo), keys, time.Since(start).Seconds())
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, point := range todo {
+		queue <- point
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed > 0 {
+		log.Errorf("%d points failed, run the sweep again to retry them", failed)
+		return 1
+	}
+	return 0
+}
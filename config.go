@@ -0,0 +1,377 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Config describes a simulation scenario. It is loaded from a JSON file and the
+// command line flags override the fields given in the file.
+type Config struct {
+	Seed     int64  `json:"seed"` // 0 means a seed derived from the current time
+	Debug    bool   `json:"debug"`
+	LogLevel int    `json:"logLevel"`
+	Queue    string `json:"queue,omitempty"`    // Scheduler of the event queue, "heap" (default) or "calendar"
+	Parallel int    `json:"parallel,omitempty"` // Goroutines of the parallel engine, 0 for the sequential one (see parallel.go)
+
+	Rate      float64 `json:"rate"`           // Block generation rate (s/block)
+	BlockSize float64 `json:"blockSize"`      // Block size (MB)
+	Duration  float64 `json:"duration"`       // Duration (in blocks)
+	Stop      string  `json:"stop,omitempty"` // Stop condition spec, replaces the duration if set (see stop.go)
+
+	HashPower  []HashChange `json:"hashPower,omitempty"`  // Changes of the hash power during the run (see hashpower.go)
+	Difficulty string       `json:"difficulty,omitempty"` // Difficulty adjuster spec, fixed if empty (see difficulty.go)
+	Clock      ClockConfig  `json:"clock,omitempty"`      // Clocks of the nodes and timestamp rules (see clock.go)
+	ForkChoice string       `json:"forkChoice,omitempty"` // Fork choice spec, "ghost" (default) or "ghast" (see forkchoice.go)
+	TieBreak   string       `json:"tieBreak,omitempty"`   // Fork choice between subtrees of the same weight, "residual" (default), "hash", "first-seen" or "random"
+	Risk       float64      `json:"risk,omitempty"`       // Adversary share assumed by the confirmation risk validator, 0 to disable (see risk.go)
+
+	Miners   MinerConfig    `json:"miners"`
+	Network  NetworkConfig  `json:"network"`
+	Attacker AttackerConfig `json:"attacker"`
+}
+
+// The Type of networks and the Strategy of miners are component specs (see
+// registry.go). Params sets the parameters of the component, the arguments in the
+// spec take precedence over them.
+
+type MinerConfig struct {
+	Honest  int                    `json:"honest"`            // Number of honest miners
+	Weights []float64              `json:"weights,omitempty"` // Weights of honest miners, equal weights if empty
+	Type    string                 `json:"type"`              // Miner spec of honest miners
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+type NetworkConfig struct {
+	Type   string                 `json:"type"` // Network spec, e.g. "bitcoin" or "simple:honestDelay=10"
+	Params map[string]interface{} `json:"params,omitempty"`
+
+	Bandwidth  float64 `json:"bandwidth"`  // Mbps
+	BufferSize float64 `json:"bufferSize"` // MB
+	Peers      int     `json:"peers"`
+	LocalRatio float64 `json:"localRatio"`
+}
+
+type AttackerConfig struct {
+	Enabled  bool                   `json:"enabled"`
+	Monopoly bool                   `json:"monopoly"` // Miner 0 is a special honest miner
+	Ratio    float64                `json:"ratio"`    // Computation power ratio of miner 0
+	Strategy string                 `json:"strategy"` // Miner spec of miner 0, e.g. "withhold:delayRef"
+	Params   map[string]interface{} `json:"params,omitempty"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Seed:      0,
+		LogLevel:  2,
+		Rate:      5,
+		BlockSize: 4,
+		Duration:  5000,
+		Miners: MinerConfig{
+			Honest: 10000,
+			Type:   "honest",
+		},
+		Network: NetworkConfig{
+			Type:       "bitcoin",
+			Bandwidth:  20,
+			BufferSize: 32,
+			Peers:      10,
+			LocalRatio: 0.05,
+		},
+		Attacker: AttackerConfig{
+			Ratio:    0.2,
+			Strategy: "honest",
+		},
+	}
+}
+
+// Load reads a scenario file on top of the current values of cfg, so the
+// fields missing in the file keep their values.
+func (cfg *Config) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("scenario %s: %v", path, err)
+	}
+	return nil
+}
+
+// Clone returns a deep copy of cfg.
+func (cfg *Config) Clone() *Config {
+	clone := &Config{}
+	if err := json.Unmarshal([]byte(cfg.String()), clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
+// Set assigns a field given by its JSON path, e.g. "rate", "network.bandwidth" or
+// "network.params.verifyTime". The value is parsed as JSON, or taken as a string
+// if it is not valid JSON.
+func (cfg *Config) Set(path string, value string) error {
+	var tree map[string]interface{}
+	if err := json.Unmarshal([]byte(cfg.String()), &tree); err != nil {
+		return err
+	}
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		parsed = value
+	}
+
+	keys := strings.Split(path, ".")
+	node := tree
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := node[key].(map[string]interface{})
+		if !ok {
+			if _, exists := node[key]; exists && node[key] != nil {
+				return fmt.Errorf("%s: %s is not an object", path, key)
+			}
+			child = make(map[string]interface{})
+			node[key] = child
+		}
+		node = child
+	}
+	node[keys[len(keys)-1]] = parsed
+
+	content, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	updated := &Config{}
+	decoder := json.NewDecoder(strings.NewReader(string(content)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(updated); err != nil {
+		return fmt.Errorf("set %s: %v", path, err)
+	}
+	*cfg = *updated
+	return nil
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if cfg.Miners.Honest <= 0 {
+		return fmt.Errorf("need at least one honest miner")
+	}
+	if len(cfg.Miners.Weights) != 0 && len(cfg.Miners.Weights) != cfg.Miners.Honest {
+		return fmt.Errorf("%d weights given for %d honest miners", len(cfg.Miners.Weights), cfg.Miners.Honest)
+	}
+	if cfg.hasSpecialMiner() && (cfg.Attacker.Ratio <= 0 || cfg.Attacker.Ratio >= 1) {
+		return fmt.Errorf("attacker ratio must be in (0, 1)")
+	}
+	if _, err := NewEventQueue(cfg.Queue); err != nil {
+		return err
+	}
+	if _, err := ParseForkChoice(cfg.ForkChoice); err != nil {
+		return err
+	}
+	if err := validateTieBreak(cfg.TieBreak); err != nil {
+		return err
+	}
+	if cfg.Risk < 0 || cfg.Risk >= 0.5 {
+		return fmt.Errorf("risk must be in [0, 0.5)")
+	}
+	if cfg.Parallel < 0 {
+		return fmt.Errorf("parallel must not be negative")
+	}
+	if cfg.Stop != "" {
+		if _, err := ParseStopCondition(cfg.Stop); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Clock.validate(); err != nil {
+		return err
+	}
+	if cfg.Difficulty != "" {
+		if _, _, err := ParseDifficultyAdjuster(cfg.Difficulty); err != nil {
+			return err
+		}
+	}
+	if len(cfg.HashPower) > 0 {
+		if _, err := buildSchedule(cfg.minerWeights(), cfg.HashPower, DefaultTimePrecision); err != nil {
+			return err
+		}
+	}
+	if _, _, err := lookupNetwork(cfg.Network.Type, cfg.Network.Params); err != nil {
+		return err
+	}
+	if _, _, err := lookupMiner(cfg.Miners.Type, cfg.Miners.Params); err != nil {
+		return err
+	}
+	if _, _, err := lookupMiner(cfg.Attacker.Strategy, cfg.Attacker.Params); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg *Config) OracleOptions() OracleOptions {
+	options := DefaultOracleOptions()
+	options.Rate = cfg.Rate
+	options.Duration = cfg.Duration * cfg.Rate
+	options.Seed = cfg.Seed
+	options.Debug = cfg.Debug
+	options.Queue = cfg.Queue
+	options.HashPower = cfg.HashPower
+	options.Clock = cfg.Clock
+	options.TieBreak = cfg.TieBreak
+	options.ForkChoice, _ = ParseForkChoice(cfg.ForkChoice)
+	options.SpecialMiner = cfg.hasSpecialMiner()
+	if cfg.Miners.Honest == 1 && !cfg.hasSpecialMiner() {
+		options.Observer = 0
+	}
+	return options
+}
+
+// NewScenario builds an oracle with the miners and the network described by cfg.
+// The returned oracle is ready to Run.
+func NewScenario(cfg *Config) (*Oracle, error) {
+	oracle, err := newScenarioMiners(cfg)
+	if err != nil {
+		return nil, err
+	}
+	network, err := NewNetworkFromSpec(cfg, cfg.Network.Type, cfg.Network.Params)
+	if err != nil {
+		return nil, err
+	}
+	oracle.SetNetwork(network)
+	oracle.Prepare()
+	if cfg.Parallel > 0 {
+		if err := oracle.SetParallel(cfg.Parallel); err != nil {
+			return nil, err
+		}
+	}
+	return oracle, nil
+}
+
+// NewReplayScenario builds the miners described by cfg and drives them by the
+// trace read from r instead of simulating the network.
+func NewReplayScenario(cfg *Config, r io.Reader) (*Oracle, error) {
+	if cfg.Parallel > 0 {
+		return nil, fmt.Errorf("a trace can not be replayed by the parallel engine")
+	}
+	oracle, err := newScenarioMiners(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := oracle.PrepareReplay(r); err != nil {
+		return nil, err
+	}
+	return oracle, nil
+}
+
+// ResumeScenario builds the miners and the network described by cfg and loads
+// the state of a checkpoint into them. cfg may differ from the scenario of the
+// checkpoint, see Oracle.Restore.
+func ResumeScenario(cfg *Config, state *OracleState) (*Oracle, error) {
+	if cfg.Parallel > 0 {
+		return nil, fmt.Errorf("a checkpoint can not be resumed by the parallel engine")
+	}
+	oracle, err := newScenarioMiners(cfg)
+	if err != nil {
+		return nil, err
+	}
+	network, err := NewNetworkFromSpec(cfg, cfg.Network.Type, cfg.Network.Params)
+	if err != nil {
+		return nil, err
+	}
+	oracle.SetNetwork(network)
+	if err := oracle.Restore(state); err != nil {
+		return nil, err
+	}
+	return oracle, nil
+}
+
+func newScenarioMiners(cfg *Config) (*Oracle, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	oracle := NewOracle(cfg.OracleOptions())
+	oracle.AddObserver(NewReportObserver(reportInterval))
+	if cfg.Risk > 0 {
+		oracle.AddObserver(NewRiskValidator(cfg.Risk, reportInterval))
+	}
+	if cfg.Stop != "" {
+		stop, err := ParseStopCondition(cfg.Stop)
+		if err != nil {
+			return nil, err
+		}
+		oracle.SetStopCondition(stop)
+	}
+
+	weights := cfg.minerWeights()
+	if cfg.hasSpecialMiner() {
+		attacker, err := NewMinerFromSpec(cfg, cfg.Attacker.Strategy, cfg.Attacker.Params)
+		if err != nil {
+			return nil, err
+		}
+		oracle.AddMiner(attacker, weights[0])
+		weights = weights[1:]
+	}
+	for i := 0; i < cfg.Miners.Honest; i++ {
+		miner, err := NewMinerFromSpec(cfg, cfg.Miners.Type, cfg.Miners.Params)
+		if err != nil {
+			return nil, err
+		}
+		oracle.AddMiner(miner, weights[i])
+	}
+	oracle.FinalizeMiners()
+	if cfg.Difficulty != "" {
+		adjuster, view, err := ParseDifficultyAdjuster(cfg.Difficulty)
+		if err != nil {
+			return nil, err
+		}
+		if adjuster != nil {
+			if err := oracle.SetDifficultyAdjuster(adjuster, view); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return oracle, nil
+}
+
+func (cfg *Config) hasSpecialMiner() bool {
+	return cfg.Attacker.Enabled || cfg.Attacker.Monopoly
+}
+
+// minerWeights returns the weights of the miners in the order they are added.
+func (cfg *Config) minerWeights() []float64 {
+	var weights []float64
+	if cfg.hasSpecialMiner() {
+		weights = append(weights, cfg.Attacker.Ratio/(1-cfg.Attacker.Ratio))
+	}
+	for i := 0; i < cfg.Miners.Honest; i++ {
+		weights = append(weights, cfg.honestWeight(i))
+	}
+	return weights
+}
+
+// honestWeight normalizes the weights of honest miners to sum 1, so the weight
+// of the special miner can be derived from its ratio.
+func (cfg *Config) honestWeight(id int) float64 {
+	if len(cfg.Miners.Weights) == 0 {
+		return 1.0 / float64(cfg.Miners.Honest)
+	}
+	sum := 0.0
+	for _, weight := range cfg.Miners.Weights {
+		sum += weight
+	}
+	return cfg.Miners.Weights[id] / sum
+}
+
+func (cfg *Config) String() string {
+	content, err := json.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
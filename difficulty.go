@@ -0,0 +1,239 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// DifficultyAdjuster sets the difficulty of the blocks from the simulated block
+// times. The difficulty is the expected block interval (seconds) at the initial
+// hash power, so the fixed difficulty is the rate of the scenario and the block
+// interval is the difficulty divided by the total hash power (see hashpower.go).
+//
+// The adjusters read the pivot chain of a reference view, the local graph of a
+// miner, as a node of the real network would: the difficulty of the next block
+// only depends on the pivot tip of the view and its ancestors. It is read
+// whenever a block is mined, and the next block is sampled with it.
+type DifficultyAdjuster interface {
+	Difficulty(o *Oracle, tip *Block) float64
+	String() string
+}
+
+// ancestor returns the ancestor of block at height on its parent chain.
+func ancestor(block *Block, height int) *Block {
+	for block.height > height {
+		block = block.parent
+	}
+	return block
+}
+
+// clamp limits the factor of an adjustment to [1/limit, limit].
+func clamp(factor float64, limit float64) float64 {
+	return math.Max(1/limit, math.Min(limit, factor))
+}
+
+// blockSpan returns the seconds between the timestamps of two blocks, as the
+// nodes see them, at least one time slot so that the adjustments stay finite.
+func (o *Oracle) blockSpan(from *Block, to *Block) float64 {
+	return float64(max(to.timestamp-from.timestamp, 1)) / o.timePrecision
+}
+
+type retarget struct {
+	window int
+	limit  float64
+}
+
+// Retarget is the adjustment of Bitcoin: every window pivot blocks the difficulty
+// is scaled by the ratio of the expected to the actual time of the window, by a
+// factor of at most limit. As in Bitcoin, the time is measured from the first
+// block of the window, so the windows do not overlap.
+func Retarget(window int, limit float64) DifficultyAdjuster {
+	return &retarget{window: window, limit: limit}
+}
+
+func (a *retarget) Difficulty(o *Oracle, tip *Block) float64 {
+	if tip.height == 0 || tip.height%a.window != 0 {
+		return tip.difficulty
+	}
+	expected := float64(a.window) * o.rate
+	actual := o.blockSpan(ancestor(tip, tip.height-a.window+1), tip)
+	return tip.difficulty * clamp(expected/actual, a.limit)
+}
+
+func (a *retarget) String() string {
+	return fmt.Sprintf("bitcoin:window=%d,limit=%g", a.window, a.limit)
+}
+
+type emaAdjuster struct {
+	window int
+}
+
+// EMA adjusts the difficulty at every pivot block by the interval from its
+// parent, weighted by 1/window. It is an exponential moving average of the
+// intervals: D' = D / (1 + (interval/rate - 1) / window).
+func EMA(window int) DifficultyAdjuster {
+	return &emaAdjuster{window: window}
+}
+
+func (a *emaAdjuster) Difficulty(o *Oracle, tip *Block) float64 {
+	if tip.parent == nil {
+		return tip.difficulty
+	}
+	interval := o.blockSpan(tip.parent, tip)
+	return tip.difficulty / (1 + (interval/o.rate-1)/float64(a.window))
+}
+
+func (a *emaAdjuster) String() string {
+	return fmt.Sprintf("ema:window=%d", a.window)
+}
+
+type epochAdjuster struct {
+	period int
+	limit  float64
+}
+
+// EpochAdjuster is the adjustment of Conflux: every period pivot blocks, the
+// blocks of the epochs of the period are counted, so the blocks off the pivot
+// chain take part in the rate. The difficulty is scaled by the ratio of the
+// measured to the expected block rate, by a factor of at most limit.
+func EpochAdjuster(period int, limit float64) DifficultyAdjuster {
+	return &epochAdjuster{period: period, limit: limit}
+}
+
+func (a *epochAdjuster) Difficulty(o *Oracle, tip *Block) float64 {
+	if tip.height == 0 || tip.height%a.period != 0 {
+		return tip.difficulty
+	}
+	start := ancestor(tip, tip.height-a.period)
+	// The past of a pivot block holds the epochs up to it.
+	blocks := tip.ancestorNum - start.ancestorNum
+	expected := float64(blocks) * o.rate
+	return tip.difficulty * clamp(expected/o.blockSpan(start, tip), a.limit)
+}
+
+func (a *epochAdjuster) String() string {
+	return fmt.Sprintf("conflux:period=%d,limit=%g", a.period, a.limit)
+}
+
+// SetDifficultyAdjuster replaces the fixed difficulty. view is the miner whose
+// local graph is the reference view, -1 for the observer.
+func (o *Oracle) SetDifficultyAdjuster(adjuster DifficultyAdjuster, view int) error {
+	if view < 0 {
+		view = o.options.Observer
+	}
+	if view >= o.LenMiner() {
+		return fmt.Errorf("difficulty %s: no miner %d", adjuster, view)
+	}
+	miner, ok := o.miners.miners[view].(interface{ Graph() ForkChoice })
+	if !ok {
+		return fmt.Errorf("difficulty %s: miner %d has no local graph", adjuster, view)
+	}
+	o.adjuster = adjuster
+	o.adjusterView = miner.Graph()
+	return nil
+}
+
+// difficulty returns the difficulty of the next block, at least two time slots
+// so the sampling of the arrivals stays defined.
+func (o *Oracle) difficulty() float64 {
+	if o.adjuster == nil || o.adjusterView.PivotTip() == nil {
+		return o.rate
+	}
+	return math.Max(o.adjuster.Difficulty(o, o.adjusterView.PivotTip()), 2/o.timePrecision)
+}
+
+// Difficulty adjusters are given by specs in the same form as the components,
+// e.g. "bitcoin:window=2016" or "ema:window=100,view=3".
+
+type difficultyFactory struct {
+	name   string
+	usage  string
+	params []Param
+	new    func(args Args) (DifficultyAdjuster, error)
+}
+
+var viewParam = Param{Name: "view", Kind: IntParam, Default: "-1", Usage: "Miner of the reference view, -1 for the observer"}
+
+var difficultyFactories = []*difficultyFactory{
+	{
+		name:   "fixed",
+		usage:  "The rate of the scenario",
+		params: nil,
+		new: func(args Args) (DifficultyAdjuster, error) {
+			return nil, nil
+		},
+	},
+	{
+		name:  "bitcoin",
+		usage: "Retarget every window pivot blocks",
+		params: []Param{
+			{Name: "window", Kind: IntParam, Default: "2016", Usage: "Pivot blocks between two adjustments"},
+			{Name: "limit", Kind: FloatParam, Default: "4", Usage: "Maximum factor of an adjustment"},
+			viewParam,
+		},
+		new: func(args Args) (DifficultyAdjuster, error) {
+			if args.Int("window") <= 0 || args.Float("limit") < 1 {
+				return nil, fmt.Errorf("window must be positive and limit at least 1")
+			}
+			return Retarget(args.Int("window"), args.Float("limit")), nil
+		},
+	},
+	{
+		name:  "ema",
+		usage: "Exponential moving average of the pivot block intervals",
+		params: []Param{
+			{Name: "window", Kind: IntParam, Default: "100", Usage: "Inverse of the weight of the last interval"},
+			viewParam,
+		},
+		new: func(args Args) (DifficultyAdjuster, error) {
+			if args.Int("window") < 2 {
+				return nil, fmt.Errorf("window must be at least 2")
+			}
+			return EMA(args.Int("window")), nil
+		},
+	},
+	{
+		name:  "conflux",
+		usage: "Retarget on the blocks of the epochs every period pivot blocks",
+		params: []Param{
+			{Name: "period", Kind: IntParam, Default: "5000", Usage: "Pivot blocks between two adjustments"},
+			{Name: "limit", Kind: FloatParam, Default: "2", Usage: "Maximum factor of an adjustment"},
+			viewParam,
+		},
+		new: func(args Args) (DifficultyAdjuster, error) {
+			if args.Int("period") <= 0 || args.Float("limit") < 1 {
+				return nil, fmt.Errorf("period must be positive and limit at least 1")
+			}
+			return EpochAdjuster(args.Int("period"), args.Float("limit")), nil
+		},
+	},
+}
+
+// ParseDifficultyAdjuster builds the adjuster described by spec and returns the
+// miner of its reference view. The adjuster is nil for the fixed difficulty.
+func ParseDifficultyAdjuster(spec string) (DifficultyAdjuster, int, error) {
+	name, raw := splitSpec(spec)
+	for _, f := range difficultyFactories {
+		if f.name == name {
+			args, err := bindArgs(name, f.params, nil, raw)
+			if err != nil {
+				return nil, 0, err
+			}
+			adjuster, err := f.new(args)
+			if err != nil || adjuster == nil {
+				return nil, 0, err
+			}
+			return adjuster, args.Int("view"), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("unknown difficulty adjuster %q", name)
+}
+
+func listDifficultyAdjusters(w io.Writer) {
+	fmt.Fprintln(w, "Difficulty adjusters:")
+	for _, f := range difficultyFactories {
+		fmt.Fprintf(w, "  %-16s %s\n", f.name, f.usage)
+		writeParams(w, f.params)
+	}
+}
@@ -1,6 +1,4 @@
-package main
-
-import "time"
+package simulator
 
 type GenBlockEvent struct {
 	BaseEvent
@@ -8,33 +6,20 @@ type GenBlockEvent struct {
 }
 
 func (e *GenBlockEvent) Run(o *Oracle) []Event {
-	log.Debugf("GenBlock  Event: time %.2f, block %d, miner %d", o.getRealTime(), e.block.index, e.block.minerID)
-
-	miner := o.getMiner(e.block.minerID)
-	e.block.seen[e.block.minerID] = true
-
-	if e.block.index%50 == 0 {
-		t := float64(o.timestamp) / o.timePrecision
-		log.Warning("")
-		log.Warningf("Current time: %.2f s", t)
-
-		viewGraph := o.miners.miners[1].(*HonestMiner).graph
+	log.Debugf("GenBlock  Event: time %.2f, block %d, miner %d", o.RealTime(), e.block.index, e.block.minerID)
 
-		log.Noticef("Pivot block %d", viewGraph.pivotTip.block.index)
-		viewGraph.report_pivot()
+	miner := o.GetMiner(e.block.minerID)
+	e.block.time = o.timestamp
+	e.block.timestamp = o.LocalTime(e.block.minerID)
+	e.block.see(e.block.minerID, o.LenMiner())
+	o.mined++
 
-		if e.block.index%50 == 0 {
-			viewGraph.report_anti(20)
-			viewGraph.report_epochsize()
-		}
-
-		time.Sleep(1 * time.Millisecond)
-		log.Warning("")
-	}
-	//time.Sleep(300 * time.Millisecond)
 	events := miner.GenerateBlock(e.block)
+	o.notifyMined(e.block)
 
-	events = append(events, o.mineNextBlock())
+	if !o.replaying {
+		events = append(events, o.mineNextBlock())
+	}
 	return events
 }
 
@@ -44,10 +29,27 @@ type SendBlockEvent struct {
 	receiverID int
 }
 
-func (e *SendBlockEvent) Run(o *Oracle) ([]Event) {
-	log.Debugf("SendBlock Event: time %.2f, block %d, receiver %d", o.getRealTime(), e.block.index, e.receiverID)
+// NewSendBlockEvent delivers block to the miner receiverID at timestamp.
+func NewSendBlockEvent(timestamp int64, block *Block, receiverID int) *SendBlockEvent {
+	return &SendBlockEvent{
+		BaseEvent:  BaseEvent{timestamp: timestamp},
+		block:      block,
+		receiverID: receiverID,
+	}
+}
 
-	receiver := o.getMiner(e.receiverID)
-	e.block.seen[e.receiverID] = true
-	return receiver.ReceiveBlock(e.block)
+func (e *SendBlockEvent) Run(o *Oracle) ([]Event) {
+	log.Debugf("SendBlock Event: time %.2f, block %d, receiver %d", o.realTimeAt(e.receiverID), e.block.index, e.receiverID)
+
+	receiver := o.GetMiner(e.receiverID)
+	if p := o.windowPartition(e.receiverID); p != nil {
+		p.atCommit(func() {
+			e.block.see(e.receiverID, o.LenMiner())
+		})
+	} else {
+		e.block.see(e.receiverID, o.LenMiner())
+	}
+	events := receiver.ReceiveBlock(e.block)
+	o.notifyDelivered(e.block, e.receiverID)
+	return events
 }
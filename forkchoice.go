@@ -0,0 +1,154 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ForkChoice is the view of the blocks of a node and the rule which picks its
+// pivot chain and orders the blocks. The miners mine and relay through it, and
+// the reports only read it through this interface, so protocols can be compared
+// on the same network runs. LocalGraph implements GHOST on the tree graph of
+// Conflux, and GHAST with adaptive weights.
+//
+// A fork choice is checkpointed if it is a LocalGraph or implements Stateful.
+// The observers only see the pivot changes of a LocalGraph.
+type ForkChoice interface {
+	// Insert adds a block to the view. It returns Fail if an ancestor is not in
+	// the view yet, the block can be inserted again later.
+	Insert(block *Block) InsertResult
+	// FillNewBlock links a new block to the blocks the rule mines on.
+	FillNewBlock(block *Block)
+	// PivotTip returns the last block of the pivot chain, nil if the view is
+	// empty. The pivot chain is the tip and its ancestors.
+	PivotTip() *Block
+	// Contains reports whether the block is in the view.
+	Contains(block *Block) bool
+	// Size returns the number of blocks in the view, genesis included.
+	Size() int
+	// Order returns the blocks of the past of the pivot tip in the total order
+	// of the protocol. The slice belongs to the fork choice and is valid until
+	// the next insertion.
+	Order() []*Block
+	// Epoch returns the pivot height of the epoch of a block in the total
+	// order, -1 if it is not ordered.
+	Epoch(block *Block) int
+}
+
+// ForkChoiceBuilder builds the fork choice of a miner.
+type ForkChoiceBuilder func(o *Oracle, miner int) ForkChoice
+
+// Fork choices are given by specs in the same form as the components, e.g.
+// "ghast:beta=1000", and register a factory under their name.
+type ForkChoiceFactory struct {
+	Name   string
+	Usage  string
+	Params []Param
+	New    func(args Args) (ForkChoiceBuilder, error)
+}
+
+const defaultForkChoice = "ghost"
+
+var forkChoiceFactories = make(map[string]*ForkChoiceFactory)
+
+func RegisterForkChoice(f *ForkChoiceFactory) {
+	if _, ok := forkChoiceFactories[f.Name]; ok {
+		log.Panicf("fork choice %s registered twice", f.Name)
+	}
+	forkChoiceFactories[f.Name] = f
+}
+
+// ParseForkChoice returns the builder of the fork choice described by spec, GHOST
+// if it is empty.
+func ParseForkChoice(spec string) (ForkChoiceBuilder, error) {
+	if spec == "" {
+		spec = defaultForkChoice
+	}
+	name, raw := splitSpec(spec)
+	factory, ok := forkChoiceFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fork choice %q", name)
+	}
+	args, err := bindArgs(name, factory.Params, nil, raw)
+	if err != nil {
+		return nil, err
+	}
+	return factory.New(args)
+}
+
+func listForkChoices(w io.Writer) {
+	names := make([]string, 0, len(forkChoiceFactories))
+	for name := range forkChoiceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Fork choices:")
+	for _, name := range names {
+		f := forkChoiceFactories[name]
+		fmt.Fprintf(w, "  %-16s %s\n", f.Name, f.Usage)
+		writeParams(w, f.Params)
+	}
+}
+
+// newForkChoice builds the fork choice of a miner with the rule of the scenario.
+func (o *Oracle) newForkChoice(miner int) ForkChoice {
+	build := o.options.ForkChoice
+	if build == nil {
+		build, _ = ParseForkChoice(defaultForkChoice)
+	}
+	return build(o, miner)
+}
+
+// containsAncestors reports whether the parent and the references of a block are
+// in the view.
+func containsAncestors(g ForkChoice, block *Block) bool {
+	if block.parent != nil && !g.Contains(block.parent) {
+		return false
+	}
+	for _, ref := range block.references {
+		if !g.Contains(ref) {
+			return false
+		}
+	}
+	return true
+}
+
+// confirms reports whether a pivot block at least depth blocks below the pivot
+// tip has block in its past, i.e. whether the epoch of block is that deep.
+func confirms(g ForkChoice, block *Block, depth int) bool {
+	tip := g.PivotTip()
+	if tip == nil {
+		return false
+	}
+	epoch := g.Epoch(block)
+	return epoch >= 0 && epoch <= tip.height-depth
+}
+
+// saveForkChoice returns the checkpoint of the fork choice of a miner.
+func saveForkChoice(g ForkChoice) (interface{}, error) {
+	switch g := g.(type) {
+	case *LocalGraph:
+		return g.saveState(), nil
+	case Stateful:
+		return g.SaveState()
+	}
+	return nil, fmt.Errorf("fork choice %T can not be checkpointed", g)
+}
+
+// loadForkChoice restores the fork choice of a miner. The blocks must be
+// restored in the oracle already.
+func (o *Oracle) loadForkChoice(g ForkChoice, state interface{}) error {
+	switch g := g.(type) {
+	case *LocalGraph:
+		s, ok := state.(*localGraphState)
+		if !ok {
+			return fmt.Errorf("can not restore a local graph from %T", state)
+		}
+		g.loadState(o.blocks, s)
+		return nil
+	case Stateful:
+		return g.LoadState(state)
+	}
+	return fmt.Errorf("fork choice %T can not be restored", g)
+}
@@ -1,4 +1,4 @@
-package main
+package simulator
 
 var geoN = 20
 var geodelay = [][]float64{
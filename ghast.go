@@ -0,0 +1,183 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// GHAST, the adaptive weights of the fork choice of Conflux. A block is adaptive
+// if its past shows a liveness attack: a block on the chain of its parent which
+// holds less than alpha of the weight below its own parent, while that weight is
+// above beta, i.e. a fork which stays balanced. An adaptive block weighs heavy
+// with probability 1/heavy and 0 otherwise, so it weighs 1 on average as the
+// other blocks, but a heavy block breaks the balance.
+//
+// The adaptivity only depends on the past of the block, so it is decided once,
+// by the first GHAST graph which inserts the block, and shared by the nodes.
+
+type GhastConfig struct {
+	Alpha float64 // Share of the weight below its parent a block on the chain must hold
+	Beta  int     // Weight below the parent above which a fork is checked
+	Heavy int     // Weight of a heavy adaptive block, the inverse of the chance to be heavy
+}
+
+// adaptivity is whether a block is adaptive, see GhastConfig.
+type adaptivity int8
+
+const (
+	undecided adaptivity = iota // Not inserted in a GHAST graph yet
+	steady
+	adaptive
+)
+
+func init() {
+	RegisterForkChoice(&ForkChoiceFactory{
+		Name:  "ghost",
+		Usage: "Heaviest subtree, every block weighs 1",
+		New: func(args Args) (ForkChoiceBuilder, error) {
+			return localGraphBuilder(nil), nil
+		},
+	})
+	RegisterForkChoice(&ForkChoiceFactory{
+		Name:  "ghast",
+		Usage: "Heaviest subtree with the adaptive weights of Conflux",
+		Params: []Param{
+			{Name: "alpha", Kind: FloatParam, Default: "0.67", Usage: "A fork is balanced if the chain holds less than this share of the weight"},
+			{Name: "beta", Kind: IntParam, Default: "1000", Usage: "Weight below a fork before it is checked"},
+			{Name: "heavy", Kind: IntParam, Default: "240", Usage: "Weight of a heavy adaptive block"},
+		},
+		New: func(args Args) (ForkChoiceBuilder, error) {
+			cfg := &GhastConfig{Alpha: args.Float("alpha"), Beta: args.Int("beta"), Heavy: args.Int("heavy")}
+			if cfg.Alpha <= 0 || cfg.Alpha > 1 || cfg.Beta < 0 || cfg.Heavy < 1 {
+				return nil, fmt.Errorf("alpha must be in (0, 1], beta must not be negative and heavy must be positive")
+			}
+			return localGraphBuilder(cfg), nil
+		},
+	})
+}
+
+// localGraphBuilder builds local graphs with the adaptive weights of ghast, GHOST
+// if it is nil, and the tie-break policy of the scenario.
+func localGraphBuilder(ghast *GhastConfig) ForkChoiceBuilder {
+	return func(o *Oracle, miner int) ForkChoice {
+		g := NewLocalGraph()
+		g.debug = o.options.Debug
+		g.ghast = ghast
+		o.setTieBreak(g, miner)
+		return g
+	}
+}
+
+// heavyDraw is the draw which makes an adaptive block heavy. Like the hash, it
+// only depends on the seed and the index of the block, but it has its own key:
+// the heavy blocks would otherwise have the lowest hashes and win the ties.
+func (o *Oracle) heavyDraw(index int) uint64 {
+	return mix64(uint64(deriveSeed(o.options.Seed, "heavy")), uint64(index))
+}
+
+// blockWeight returns the weight of a block in the fork choice of the graph. The
+// adaptivity of the block must be decided.
+func (g *LocalGraph) blockWeight(block *Block) int {
+	if g.ghast == nil || block.adaptive != adaptive {
+		return 1
+	}
+	if block.heavy < math.MaxUint64/uint64(g.ghast.Heavy) {
+		return g.ghast.Heavy
+	}
+	return 0
+}
+
+// decideAdaptive decides the adaptivity of a block whose past is in the graph,
+// unless another graph did.
+func (g *LocalGraph) decideAdaptive(block *Block) {
+	if g.ghast == nil || block.adaptive != undecided {
+		return
+	}
+	block.adaptive = steady
+	if block.parent == nil {
+		return
+	}
+	var balanced bool
+	if g.isPast(block) {
+		balanced = g.balancedChain(block.parent)
+	} else {
+		balanced = g.balancedPast(block)
+	}
+	if balanced {
+		block.adaptive = adaptive
+	}
+}
+
+// isPast reports whether the graph is the past of a block, i.e. the block has
+// every tip as parent or reference, as a block mined on the graph.
+func (g *LocalGraph) isPast(block *Block) bool {
+	covered := 0
+	if g.tips.Has(block.parent.index) {
+		covered++
+	}
+	for _, ref := range block.references {
+		if g.tips.Has(ref.index) {
+			covered++
+		}
+	}
+	return covered == g.tips.Len()
+}
+
+// balanced reports whether a block holds less than alpha of the weight below its
+// parent, given the subtree weights of both.
+func (g *LocalGraph) balanced(weight int, below int) bool {
+	return below > g.ghast.Beta && float64(weight) < g.ghast.Alpha*float64(below)
+}
+
+// balancedChain checks the chain of a block with the subtree weights of the
+// graph, which must be the past of a child of the block.
+func (g *LocalGraph) balancedChain(tip *Block) bool {
+	for db := g.ledger[tip.index]; !db.isGenesis(); db = db.parent {
+		below := db.parent.getWeight(g) - g.blockWeight(db.parent.block)
+		if g.balanced(db.getWeight(g), below) {
+			return true
+		}
+	}
+	return false
+}
+
+// balancedPast checks the chain of the parent of a block with the subtree weights
+// in its past, which is only a part of the graph.
+func (g *LocalGraph) balancedPast(block *Block) bool {
+	visited := map[*Block]bool{}
+	past := []*Block{block.parent}
+	past = append(past, block.references...)
+	for _, b := range past {
+		visited[b] = true
+	}
+	for i := 0; i < len(past); i++ {
+		b := past[i]
+		for _, parent := range append(b.references[:len(b.references):len(b.references)], b.parent) {
+			if parent != nil && !visited[parent] {
+				visited[parent] = true
+				past = append(past, parent)
+			}
+		}
+	}
+
+	// A block is generated after its parent and its references, so the
+	// children come first in the decreasing order of index.
+	sort.Slice(past, func(i, j int) bool {
+		return past[i].index > past[j].index
+	})
+	subtree := make(map[*Block]int, len(past))
+	for _, b := range past {
+		subtree[b] += g.blockWeight(b)
+		if b.parent != nil {
+			subtree[b.parent] += subtree[b]
+		}
+	}
+
+	for b := block.parent; b.parent != nil; b = b.parent {
+		if g.balanced(subtree[b], subtree[b.parent]-g.blockWeight(b.parent)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,3 @@
+module github.com/Conflux-Chain/conflux-simulator
+
+go 1.22
@@ -0,0 +1,187 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// HashChange changes the hash power of a miner during a run. Factor multiplies the
+// initial weight of the miner: 2 doubles its hash power, 0 switches it off and 1
+// restores it. The new factor is reached linearly over Ramp seconds, or at once
+// if Ramp is 0. The total hash power is not normalized, so the block rate follows
+// it: doubling every miner halves the block interval.
+type HashChange struct {
+	Time   float64 `json:"time"`           // Seconds
+	Miner  int     `json:"miner"`          // -1 for every miner
+	Factor float64 `json:"factor"`         // Multiplier of the initial weight
+	Ramp   float64 `json:"ramp,omitempty"` // Seconds
+}
+
+const rampSteps = 20 // A ramp is approximated by this many constant steps
+
+func (c HashChange) String() string {
+	return fmt.Sprintf("%gs: miner %d x%g", c.Time, c.Miner, c.Factor)
+}
+
+func (c HashChange) validate(miners int) error {
+	if c.Time < 0 || c.Ramp < 0 {
+		return fmt.Errorf("hash change %s: time and ramp must not be negative", c)
+	}
+	if c.Factor < 0 {
+		return fmt.Errorf("hash change %s: factor must not be negative", c)
+	}
+	if c.Miner < -1 || c.Miner >= miners {
+		return fmt.Errorf("hash change %s: no miner %d out of %d", c, c.Miner, miners)
+	}
+	return nil
+}
+
+// hashSegment is a period of constant hash power.
+type hashSegment struct {
+	start    int64     // First time slot
+	total    float64   // Total hash power, 1 at the beginning of the run
+	cumTable []float64 // Normalized as MinerSet.cumTable, nil if total is 0
+}
+
+// buildSchedule cuts the run into periods of constant hash power. weights are the
+// normalized initial weights.
+func buildSchedule(weights []float64, changes []HashChange, timePrecision float64) ([]hashSegment, error) {
+	type step struct {
+		start  int64
+		miner  int
+		factor float64
+	}
+	var steps []step
+
+	sorted := append([]HashChange(nil), changes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time < sorted[j].Time
+	})
+	factors := make([]float64, len(weights))
+	for i := range factors {
+		factors[i] = 1
+	}
+	for _, c := range sorted {
+		if err := c.validate(len(weights)); err != nil {
+			return nil, err
+		}
+		miners := []int{c.Miner}
+		if c.Miner == -1 {
+			miners = miners[:0]
+			for id := range weights {
+				miners = append(miners, id)
+			}
+		}
+		for _, id := range miners {
+			from := factors[id]
+			if c.Ramp > 0 {
+				// Each step takes the factor at the middle of its period.
+				for i := 0; i < rampSteps; i++ {
+					at := c.Time + c.Ramp*float64(i)/rampSteps
+					factor := from + (c.Factor-from)*(float64(i)+0.5)/rampSteps
+					steps = append(steps, step{int64(at * timePrecision), id, factor})
+				}
+			}
+			steps = append(steps, step{int64((c.Time + c.Ramp) * timePrecision), id, c.Factor})
+			factors[id] = c.Factor
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].start < steps[j].start
+	})
+
+	for i := range factors {
+		factors[i] = 1
+	}
+	segments := []hashSegment{newHashSegment(0, weights, factors)}
+	for i := 0; i < len(steps); {
+		start := steps[i].start
+		for ; i < len(steps) && steps[i].start == start; i++ {
+			factors[steps[i].miner] = steps[i].factor
+		}
+		segment := newHashSegment(start, weights, factors)
+		if last := &segments[len(segments)-1]; last.start == start {
+			*last = segment
+		} else {
+			segments = append(segments, segment)
+		}
+	}
+	if segments[len(segments)-1].total == 0 {
+		return nil, fmt.Errorf("the hash power schedule ends with no hash power")
+	}
+	return segments, nil
+}
+
+func newHashSegment(start int64, weights []float64, factors []float64) hashSegment {
+	segment := hashSegment{start: start}
+	for id, weight := range weights {
+		segment.total += weight * factors[id]
+	}
+	if segment.total == 0 {
+		return segment
+	}
+	ratio := 0.0
+	segment.cumTable = make([]float64, len(weights))
+	for id, weight := range weights {
+		ratio += weight * factors[id] / segment.total
+		segment.cumTable[id] = ratio
+	}
+	return segment
+}
+
+// segmentAt returns the index of the segment holding the time slot.
+func (ms *MinerSet) segmentAt(timestamp int64) int {
+	return sort.Search(len(ms.schedule), func(i int) bool {
+		return ms.schedule[i].start > timestamp
+	}) - 1
+}
+
+// HashPower returns the total hash power at the current time, relative to the
+// beginning of the run.
+func (o *Oracle) HashPower() float64 {
+	if o.miners.schedule == nil {
+		return 1
+	}
+	return o.miners.schedule[o.miners.segmentAt(o.timestamp)].total
+}
+
+// mineScheduled samples the next block with a hash power schedule. The arrivals
+// are memoryless, so the search restarts at the end of each segment with the rate
+// of the next one.
+func (o *Oracle) mineScheduled() Event {
+	schedule := o.miners.schedule
+	nextStamp := o.timestamp
+	seg := o.miners.segmentAt(nextStamp)
+	rate := o.difficulty()
+	var residual float64
+
+	for {
+		end := int64(math.MaxInt64)
+		if seg+1 < len(schedule) {
+			end = schedule[seg+1].start
+		}
+		if total := schedule[seg].total; total > 0 {
+			difficulty := o.timePrecision * rate / total
+			r := o.rand.Arrival.Float64()
+			fk := math.Log(r) / (math.Log(1 - 1/difficulty))
+			if math.Ceil(fk) <= float64(end-nextStamp) {
+				k := int64(math.Ceil(fk))
+				nextStamp += k
+				residual = float64(k) - fk
+				break
+			}
+		}
+		nextStamp = end
+		seg++
+	}
+
+	pickedID := sort.SearchFloat64s(schedule[seg].cumTable, o.rand.Miner.Float64())
+	block := o.newBlock(pickedID, residual)
+	block.difficulty = rate
+
+	return &GenBlockEvent{
+		BaseEvent: BaseEvent{timestamp: nextStamp},
+		block:     block,
+	}
+}
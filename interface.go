@@ -1,6 +1,4 @@
-package main
-
-import "container/heap"
+package simulator
 
 type Miner interface {
 	Setup(*Oracle, int)
@@ -19,7 +17,10 @@ type Event interface {
 	Run(o *Oracle) []Event
 	SetIndex(int)
 	GetIndex() int
+	SetSeq(uint64)
+	GetSeq() uint64
 	SetQueue(*EventQueue)
+	base() *BaseEvent // Events embed BaseEvent
 }
 
 type PacketSent interface {
@@ -29,7 +30,16 @@ type PacketSent interface {
 type BaseEvent struct {
 	timestamp int64
 	index     int
+	seq       uint64 // Insertion sequence, breaks the ties of timestamp
 	eq        *EventQueue
+	bucket    int  // Bucket of the calendar queue
+	fired     bool // Popped from the queue and not pushed again
+	cancelled bool
+}
+
+// NewBaseEvent is used by the events defined outside of this package.
+func NewBaseEvent(timestamp int64) BaseEvent {
+	return BaseEvent{timestamp: timestamp}
 }
 
 func (e *BaseEvent) GetTimestamp() int64 {
@@ -44,6 +54,14 @@ func (e *BaseEvent) GetIndex() int {
 	return e.index
 }
 
+func (e *BaseEvent) SetSeq(seq uint64) {
+	e.seq = seq
+}
+
+func (e *BaseEvent) GetSeq() uint64 {
+	return e.seq
+}
+
 func (e *BaseEvent) SetQueue(eq *EventQueue) {
 	e.eq = eq
 }
@@ -52,11 +70,29 @@ func (e *BaseEvent) GetQueue() *EventQueue {
 	return e.eq
 }
 
+func (e *BaseEvent) base() *BaseEvent {
+	return e
+}
+
+// Cancelled reports whether the event has been cancelled, see EventQueue.Cancel.
+func (e *BaseEvent) Cancelled() bool {
+	return e.cancelled
+}
+
 func (e *BaseEvent) ChangeTime(timestamp int64) {
 	e.timestamp = timestamp
 	if e.eq == nil {
 		return
 	} else {
-		heap.Fix(e.eq.queueList, e.index)
+		e.eq.sched.fix(e)
 	}
 }
+
+// Stateful is implemented by the miners and networks which can be checkpointed.
+// SaveState returns a value encodable by encoding/gob, its type must be registered
+// with gob.Register. LoadState is called after Setup, when the blocks of the
+// oracle are restored already.
+type Stateful interface {
+	SaveState() (interface{}, error)
+	LoadState(state interface{}) error
+}
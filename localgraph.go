@@ -1,38 +1,65 @@
-package main
+package simulator
 
-import (
-	"container/list"
-)
+import "sort"
 
 type DetailedBlock struct {
 	block    *Block
 	parent   *DetailedBlock
 	maxChild *DetailedBlock
-	weight   int
+	weight   int  // Subtree weight, minus weightSum for the pivot blocks
+	pivot    bool // On the pivot chain
+	order    int // Insertion order in the local graph, see TieFirstSeen
+	epoch    int // Pivot height of the epoch in the total order, -1 if not ordered yet
+
+	// Cache of the N+c antiset, valid while antiPivot is the pivot block of the
+	// epoch c = antiDepth epochs later
+	anti      int
+	antiPivot *DetailedBlock
+	antiDepth int
 }
 
 func (db *DetailedBlock) isPivot() bool {
-	return db.weight <= 0
+	return db.pivot
 }
 
 func (db *DetailedBlock) isGenesis() bool {
 	return db.block.parent == nil
 }
 
-func (db *DetailedBlock) getWeight(g *LocalGraph) float64 {
+func (db *DetailedBlock) getWeight(g *LocalGraph) int {
 	if db.isPivot() {
-		return float64(g.totalWeight+db.weight) + db.block.residual
+		return g.weightSum + db.weight
 	} else {
-		return float64(db.weight) + db.block.residual
+		return db.weight
+	}
+}
+
+// heavier reports whether the subtree of a outweighs the one of b, the ties are
+// broken by the tie-break policy of the graph.
+func (g *LocalGraph) heavier(a *DetailedBlock, b *DetailedBlock) bool {
+	wa, wb := a.getWeight(g), b.getWeight(g)
+	if wa != wb {
+		return wa > wb
+	}
+	if g.tieBreak == nil {
+		return residualTieBreak(a, b)
 	}
+	return g.tieBreak(a, b)
 }
 
 type LocalGraph struct {
 	ledger      map[int]*DetailedBlock
-	totalWeight int
+	totalWeight int // Number of blocks
+	weightSum   int // Sum of the weights of the blocks, totalWeight unless the weights are adaptive
 	tips        *Set
 	pivotTip    *DetailedBlock
 	genesis     *DetailedBlock
+
+	debug    bool                  // Check consistency after each insertion
+	tieBreak tieBreak              // Fork choice between subtrees of the same weight, nil for residualTieBreak
+	onPivot  func(old, new *Block) // Called when the pivot tip changes, nil if not watched
+	order    totalOrder            // See order.go
+	ghast    *GhastConfig          // Adaptive weights, nil for GHOST
 }
 
 func NewLocalGraph() *LocalGraph {
@@ -44,6 +71,33 @@ func NewLocalGraph() *LocalGraph {
 	}
 }
 
+// PivotTip returns the last block of the pivot chain, nil if the graph is empty.
+func (g *LocalGraph) PivotTip() *Block {
+	if g.pivotTip == nil {
+		return nil
+	}
+	return g.pivotTip.block
+}
+
+func (g *LocalGraph) Size() int {
+	return g.totalWeight
+}
+
+func (g *LocalGraph) Contains(block *Block) bool {
+	return g.existing(block)
+}
+
+// Epoch returns the pivot height of the epoch of a block, -1 if it is not in the
+// past of the pivot tip.
+func (g *LocalGraph) Epoch(block *Block) int {
+	g.updateOrder()
+	db := g.getDetailedBlock(block)
+	if db == nil {
+		return -1
+	}
+	return db.epoch
+}
+
 func (g *LocalGraph) existing(block *Block) bool {
 	_, ok := g.ledger[block.index]
 	return ok
@@ -97,7 +151,9 @@ func (g *LocalGraph) updateTips(db *DetailedBlock) {
 	if db.isGenesis() {
 		parents = db.block.references
 	} else {
-		parents = append(db.block.references, db.block.parent)
+		// The references are shared by the miners, append to a copy.
+		refs := db.block.references
+		parents = append(refs[:len(refs):len(refs)], db.block.parent)
 	}
 	for _, refBlock := range parents {
 		if g.tips.Has(refBlock.index) {
@@ -116,13 +172,10 @@ func (g *LocalGraph) updateMaxChild(db *DetailedBlock) bool {
 		return false
 	}
 
-	maxWeight := 0.0
 	var maxBlock *DetailedBlock
 	for _, childBlock := range children {
-		weight := childBlock.getWeight(g)
-		if weight > maxWeight {
+		if maxBlock == nil || g.heavier(childBlock, maxBlock) {
 			maxBlock = childBlock
-			maxWeight = weight
 		}
 	}
 	db.maxChild = maxBlock
@@ -134,21 +187,90 @@ func (g *LocalGraph) updateMaxChild(db *DetailedBlock) bool {
 	}
 }
 
-func (g *LocalGraph) fillNewBlock(block *Block) {
-	block.parent = g.pivotTip.block
-	block.parent.children = append(block.parent.children, block)
+func (g *LocalGraph) FillNewBlock(block *Block) {
+	parent := g.pivotTip.block
 
-	block.height = block.parent.height + 1
-	block.ancestorNum = g.totalWeight
-
-	block.references = make([]*Block, 0)
+	references := make([]*Block, 0)
 	for _, index := range g.tips.List() {
-		if index != block.parent.index {
-			refBlock := g.ledger[index].block
-			block.references = append(block.references, refBlock)
-			refBlock.refChildren = append(refBlock.refChildren, block)
+		if index != parent.index {
+			references = append(references, g.ledger[index].block)
+		}
+	}
+	block.Link(parent, references, g.totalWeight)
+}
+
+// localGraphState is the checkpoint of a LocalGraph. Entries are stored in the
+// order of block index.
+type localGraphState struct {
+	Blocks      []int
+	Weights     []int
+	MaxChild    []int // -1 for no child
+	Orders      []int
+	TotalWeight int
+	Tips        []int
+	PivotTip    int // -1 for an empty graph
+}
+
+func (g *LocalGraph) saveState() *localGraphState {
+	state := &localGraphState{TotalWeight: g.totalWeight, Tips: g.tips.List(), PivotTip: -1}
+	for index := range g.ledger {
+		state.Blocks = append(state.Blocks, index)
+	}
+	sort.Ints(state.Blocks)
+	for _, index := range state.Blocks {
+		db := g.ledger[index]
+		maxChild := -1
+		if db.maxChild != nil {
+			maxChild = db.maxChild.block.index
+		}
+		state.Weights = append(state.Weights, db.weight)
+		state.MaxChild = append(state.MaxChild, maxChild)
+		state.Orders = append(state.Orders, db.order)
+	}
+	if g.pivotTip != nil {
+		state.PivotTip = g.pivotTip.block.index
+	}
+	return state
+}
+
+// loadState replaces the content of the graph. The blocks must be restored in
+// the oracle already.
+func (g *LocalGraph) loadState(blocks []*Block, state *localGraphState) {
+	g.ledger = make(map[int]*DetailedBlock)
+	for idx, index := range state.Blocks {
+		g.ledger[index] = &DetailedBlock{block: blocks[index], weight: state.Weights[idx], epoch: -1}
+		if idx < len(state.Orders) {
+			g.ledger[index].order = state.Orders[idx]
+		}
+	}
+	for idx, index := range state.Blocks {
+		db := g.ledger[index]
+		if db.isGenesis() {
+			g.genesis = db
+		} else {
+			db.parent = g.ledger[db.block.parent.index]
+		}
+		if state.MaxChild[idx] >= 0 {
+			db.maxChild = g.ledger[state.MaxChild[idx]]
 		}
 	}
+	g.totalWeight = state.TotalWeight
+	g.weightSum = 0
+	for _, db := range g.ledger {
+		g.weightSum += g.blockWeight(db.block)
+	}
+	for db := g.genesis; db != nil; db = db.maxChild {
+		db.pivot = true
+	}
+	g.order = totalOrder{}
+	g.tips = NewSet()
+	for _, index := range state.Tips {
+		g.tips.Add(index)
+	}
+	g.pivotTip = nil
+	if state.PivotTip >= 0 {
+		g.pivotTip = g.ledger[state.PivotTip]
+	}
 }
 
 type InsertResult int
@@ -157,9 +279,11 @@ const (
 	Success  InsertResult = iota + 1
 	Fail
 	Existing
+	Invalid  // The timestamp is not above the median of the ancestors, see clockRules
+	Future   // The timestamp is too far ahead of the local clock, the block can be inserted later
 )
 
-func (g *LocalGraph) insert(block *Block) InsertResult {
+func (g *LocalGraph) Insert(block *Block) InsertResult {
 	if g.existing(block) {
 		return Existing
 	}
@@ -168,11 +292,18 @@ func (g *LocalGraph) insert(block *Block) InsertResult {
 		return Fail
 	}
 
+	g.decideAdaptive(block)
+	weight := g.blockWeight(block)
 	g.totalWeight = g.totalWeight + 1
+	g.weightSum = g.weightSum + weight
+	if g.onPivot != nil {
+		defer g.notifyPivot(g.pivotTip)
+	}
 
-	currentBlock := &DetailedBlock{block: block, maxChild: nil, weight: 1}
+	currentBlock := &DetailedBlock{block: block, maxChild: nil, weight: weight, order: g.totalWeight, epoch: -1}
 	if currentBlock.isGenesis() {
-		currentBlock.weight = g.totalWeight - currentBlock.weight
+		currentBlock.weight = currentBlock.weight - g.weightSum
+		currentBlock.pivot = true
 		currentBlock.parent = nil
 		g.genesis = currentBlock
 	} else {
@@ -191,7 +322,7 @@ func (g *LocalGraph) insert(block *Block) InsertResult {
 
 	for !currentBlock.isPivot() {
 		g.updateMaxChild(currentBlock)
-		currentBlock.weight = currentBlock.weight + 1
+		currentBlock.weight = currentBlock.weight + weight
 		currentBlock = currentBlock.parent
 	}
 
@@ -200,7 +331,7 @@ func (g *LocalGraph) insert(block *Block) InsertResult {
 
 	currentBlock = oldBranch
 	for currentBlock != nil {
-		currentBlock.weight = currentBlock.weight - 1
+		currentBlock.weight = currentBlock.weight - weight
 		currentBlock = currentBlock.maxChild
 	}
 
@@ -208,197 +339,95 @@ func (g *LocalGraph) insert(block *Block) InsertResult {
 	newBranch := pivotPoint.maxChild
 
 	if updated {
+		g.order.pivotChanged(pivotPoint.block.height + 1)
 		currentBlock = oldBranch
 		for currentBlock != nil {
-			currentBlock.weight = currentBlock.weight + g.totalWeight
+			currentBlock.weight = currentBlock.weight + g.weightSum
+			currentBlock.pivot = false
 			currentBlock = currentBlock.maxChild
 		}
 
 		currentBlock = newBranch
 		for currentBlock != nil {
 			g.pivotTip = currentBlock
-			currentBlock.weight = currentBlock.weight - g.totalWeight
+			currentBlock.weight = currentBlock.weight - g.weightSum
+			currentBlock.pivot = true
 			currentBlock = currentBlock.maxChild
 		}
 	}
-	if debug_ {
+	if g.debug {
 		g.checkConsistency()
+		g.checkOrder()
 	}
 
 	return Success
 }
 
+func (g *LocalGraph) notifyPivot(old *DetailedBlock) {
+	if g.pivotTip == old {
+		return
+	}
+	var oldBlock *Block
+	if old != nil {
+		oldBlock = old.block
+	}
+	g.onPivot(oldBlock, g.pivotTip.block)
+}
+
 /**
  * The following code are used for statistic.
  */
 
-func (g *LocalGraph) getEpochs() (map[int]int, CountMap) {
-	epochs := make(map[int]int)
-	epochCnt := make(CountMap)
-
-	pivotBlock := g.genesis
-
-	epochs[pivotBlock.block.index] = 0
-	for pivotBlock.maxChild != nil {
-		pivotBlock = pivotBlock.maxChild
-		visitList := list.New()
-		epoch := pivotBlock.block.height
-		visitList.PushBack(pivotBlock)
-		for e := visitList.Front(); e != nil; e = e.Next() {
-			block := *(e.Value.(*DetailedBlock))
-			if _, ok := epochs[block.block.index]; ok {
-				continue
-			}
-			epochs[block.block.index] = epoch
-			epochCnt.Incur(epoch, 1)
-			for _, refblock := range block.block.references {
-				visitList.PushBack(g.getDetailedBlock(refblock))
-			}
-			if !block.isGenesis() {
-				visitList.PushBack(block.parent)
-			}
-		}
-	}
-
-	return epochs, epochCnt
-}
-
-func (g *LocalGraph) countAnti(c int) (map[int]int, map[int]int) {
-	epochMap, _ := g.getEpochs()
-	numDesc := make(map[int]int)
+// countAnti returns the N+c antiset size of the blocks whose epoch is at least c
+// epochs below the pivot tip.
+func (g *LocalGraph) countAnti(c int) map[int]int {
+	g.updateOrder()
 	result := make(map[int]int)
-	pivotWeight := make(map[int]int)
-
-	for index, epoch := range epochMap {
-		if epoch == 0 && index != 0 {
-			continue
-		}
-
-		visitList := list.New()
-		visitedSet := NewSet()
-		endEpoch := epoch + c
-		count := 0
-
-		visitList.PushBack(g.ledger[index])
-		for e := visitList.Front(); e != nil; e = e.Next() {
-			block := e.Value.(*DetailedBlock)
-			index := block.block.index
-			if visitedSet.Has(index) {
-				continue
-			}
-			visitedSet.Add(index)
-			if epochMap[index] > endEpoch || (epochMap[index] == 0 && index != 0) {
-				continue
-			}
+	maxEpoch := len(g.order.pivots) - 1
 
-			count += 1
-			children := g.getAllChildren(block)
-			refChildren := g.getAllRefChildren(block)
-			allChildren := append(refChildren, children...)
-			for _, refblock := range allChildren {
-				visitList.PushBack(refblock)
-			}
-		}
-		numDesc[index] = count
-	}
-
-	pivotBlock := g.genesis
-	pivotWeight[0] = 1
-	epoch := 0
-
-	for pivotBlock.maxChild != nil {
-		pivotBlock = pivotBlock.maxChild
-		epoch = epoch + 1
-		pivotWeight[epoch] = pivotBlock.block.ancestorNum + 1
-	}
-	maxEpoch := epoch
-
-	for index, descWeight := range numDesc {
-		if epochMap[index]+c <= maxEpoch {
-			result[index] = pivotWeight[epochMap[index]+c] - (g.ledger[index].block.ancestorNum + descWeight)
-			// Debug log
-			if result[index] < 0 {
-				//	log.Criticalf("block %d, epoch %d, ancestor %d, desc %d, sub graph %d",
-				//		g.ledger[index].block.index, epochMap[index], g.ledger[index].block.ancestorNum, descWeight, pivotWeight[epochMap[index]+c])
-				//	log.Criticalf("pivot %d", g.pivotTip.block.index)
-				//
-				//	for id, _ := range make([]int, 15) {
-				//		refc := make([]int, len(g.getAllChildren(g.ledger[id])))
-				//		for idx, block := range g.getAllChildren(g.ledger[id]) {
-				//			refc[idx] = block.block.index
-				//		}
-				//		refr := make([]int, len(g.getAllRefChildren(g.ledger[id])))
-				//		for idx, block := range g.getAllRefChildren(g.ledger[id]) {
-				//			refr[idx] = block.block.index
-				//		}
-				//		log.Criticalf("block %d, epoch %v, refc %v, refr %v", id, epochMap[id], refc, refr)
-				//	}
-				log.Fatal("")
-			}
+	for _, block := range g.order.blocks {
+		db := g.ledger[block.index]
+		if db.epoch+c <= maxEpoch {
+			result[block.index] = g.antiset(db, c)
 		}
-
 	}
 
-	return result, epochMap
+	return result
 }
 
-func (g *LocalGraph) report_pivot() (CountMap, CountMap, CountMap) {
-	weight := g.totalWeight
-	pivot := g.pivotTip.block.height
-
-	pivotCnt := make(CountMap)
-	lastPivotCnt := make(CountMap)
-	pivotRefSum := make(CountMap)
-
-	pivotBlock := g.pivotTip
-	for !pivotBlock.isGenesis() {
-		pivotCnt.Incur(pivotBlock.block.minerID, 1)
-		pivotRefSum.Incur(pivotBlock.block.minerID, len(pivotBlock.block.references))
-		pivotBlock = pivotBlock.parent
+// antiset returns the N+c antiset size of an ordered block: the blocks in the
+// past of the pivot block c epochs after the block, which are neither in the past
+// nor in the future of the block. It only depends on that pivot block, so it is
+// cached until the pivot chain changes at its height.
+func (g *LocalGraph) antiset(db *DetailedBlock, c int) int {
+	pivot := g.order.pivots[db.epoch+c]
+	if db.antiPivot == pivot && db.antiDepth == c {
+		return db.anti
 	}
 
-	// For log
-	miner0Pivot := pivotCnt[0]
-
-	log.Warningf("%d(%d) pivot, %d from miner 0; ratio %.3f, %.3f;",
-		pivot, weight, miner0Pivot, float64(pivot)/float64(weight), float64(miner0Pivot)/float64(pivot))
-
-	return pivotCnt, lastPivotCnt, pivotRefSum
-}
-
-func (g *LocalGraph) report_anti(c int) (CountMap, CountMap) {
-	anti, epoch := g.countAnti(c)
-	maxEpoch := g.pivotTip.block.height
-
-	blockCnt := make(CountMap)
-	antiSum := make(CountMap)
-
-	for index, num := range anti {
-		if epoch[index] < maxEpoch-100 {
-
+	// The future of the block in the past of the pivot block, the block included.
+	// The ancestors of a block of an epoch are in that epoch or an earlier one,
+	// so the search stops at the later epochs.
+	endEpoch := db.epoch + c
+	visited := map[*DetailedBlock]bool{db: true}
+	visitList := []*DetailedBlock{db}
+	for i := 0; i < len(visitList); i++ {
+		block := visitList[i]
+		children := g.getAllChildren(block)
+		refChildren := g.getAllRefChildren(block)
+		for _, child := range append(refChildren, children...) {
+			if !visited[child] && child.epoch >= 0 && child.epoch <= endEpoch {
+				visited[child] = true
+				visitList = append(visitList, child)
+			}
 		}
-		id := g.ledger[index].block.minerID
-		blockCnt.Incur(id, 1)
-		antiSum.Incur(id, num)
 	}
 
-	if hasAttacker_ || hasMonopoly_{
-		log.Warningf("N+%d Antiset in recent 100 epochs, Attacker %.3f, Honest %.3f", c,
-			float64(antiSum[0])/float64(blockCnt[0]),
-			float64(antiSum.Sum()-antiSum[0])/float64(blockCnt.Sum()-blockCnt[0]))
-	} else {
-		log.Warningf("N+%d Antiset in recent 100 epochs, %.3f", c, float64(antiSum.Sum())/float64(blockCnt.Sum()))
-	}
-	return blockCnt, antiSum
-}
-
-func (g *LocalGraph) report_epochsize() CountMap {
-	_, size := g.getEpochs()
-	pivotHeight := g.pivotTip.block.height
-	sum := 0
-	for i := 0; i < 100; i += 1 {
-		sum += size.Get(pivotHeight - i)
+	anti := pivot.block.ancestorNum + 1 - (db.block.ancestorNum + len(visitList))
+	if anti < 0 {
+		log.Fatalf("block %d, epoch %d, ancestor %d, desc %d, sub graph %d: negative antiset",
+			db.block.index, db.epoch, db.block.ancestorNum, len(visitList), pivot.block.ancestorNum+1)
 	}
-	log.Warningf("Last 100 epochs have %d blocks", sum)
-	return size
+	db.anti, db.antiPivot, db.antiDepth = anti, pivot, c
+	return anti
 }
@@ -0,0 +1,55 @@
+package simulator
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Conflux-Chain/conflux-simulator/go-logging"
+)
+
+func TestMain(m *testing.M) {
+	LoadLogger(logging.CRITICAL)
+	os.Exit(m.Run())
+}
+
+// testConfig is a small scenario on the simple network, which runs in a fraction
+// of a second.
+func testConfig(seed int64) *Config {
+	cfg := DefaultConfig()
+	cfg.Seed = seed
+	cfg.LogLevel = int(logging.CRITICAL)
+	cfg.Duration = 200
+	cfg.Miners.Honest = 30
+	cfg.Network.Type = "simple"
+	return cfg
+}
+
+// runScenario runs a scenario with the trace hash enabled.
+func runScenario(t *testing.T, cfg *Config) *Oracle {
+	t.Helper()
+	return runOracle(t, cfg, NewScenario, nil)
+}
+
+// runOracle runs the oracle built from cfg by build, e.g. NewReplayScenario, with
+// the trace hash enabled. The block events are recorded to trace if it is not
+// nil.
+func runOracle(t *testing.T, cfg *Config, build func(cfg *Config) (*Oracle, error), trace io.Writer) *Oracle {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	oracle, err := build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oracle.EnableTraceHash()
+	if trace != nil {
+		oracle.RecordTrace(trace)
+	}
+	oracle.Run()
+	if err := oracle.FlushTrace(); err != nil {
+		t.Fatal(err)
+	}
+	return oracle
+}
@@ -0,0 +1,212 @@
+package simulator
+
+import "fmt"
+
+// Metrics summarizes the local graph of the observer, with the same numbers as
+// the periodic reports (report_pivot, report_anti and report_epochsize).
+type Metrics struct {
+	Blocks             int     `json:"blocks"`             // Blocks in the local graph, genesis excluded
+	PivotHeight        int     `json:"pivotHeight"`        // Height of the pivot tip
+	PivotRatio         float64 `json:"pivotRatio"`         // Pivot blocks over all the blocks
+	AttackerPivotShare float64 `json:"attackerPivotShare"` // Share of the pivot chain mined by miner 0
+	Antiset            float64 `json:"antiset"`            // Average N+20 antiset of honest blocks
+	AttackerAntiset    float64 `json:"attackerAntiset"`    // Average N+20 antiset of the blocks of miner 0
+	EpochSize          float64 `json:"epochSize"`          // Average blocks per epoch in the last 100 epochs
+}
+
+// MetricNames lists the metrics in the order of Values.
+var MetricNames = []string{"blocks", "pivotHeight", "pivotRatio", "attackerPivotShare", "antiset", "attackerAntiset", "epochSize"}
+
+func (m *Metrics) Values() []float64 {
+	return []float64{float64(m.Blocks), float64(m.PivotHeight), m.PivotRatio, m.AttackerPivotShare, m.Antiset, m.AttackerAntiset, m.EpochSize}
+}
+
+const (
+	antisetDepth = 20  // The N of the N+c antiset
+	recentEpochs = 100 // Epochs counted by EpochSize
+)
+
+func ratio(a int, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// Metrics computes the metrics from the local graph of the observer. The
+// attacker fields are zero if there is no special miner.
+func (o *Oracle) Metrics() (*Metrics, error) {
+	graph := o.observerGraph()
+	if graph == nil {
+		return nil, fmt.Errorf("observer %d has no local graph", o.options.Observer)
+	}
+	return metrics(graph, o.options.SpecialMiner), nil
+}
+
+// PivotHeight returns the height of the pivot tip of the observer, -1 if it has
+// no local graph. Unlike Metrics it is cheap enough to be called at any time.
+func (o *Oracle) PivotHeight() int {
+	graph := o.observerGraph()
+	if graph == nil || graph.PivotTip() == nil {
+		return -1
+	}
+	return graph.PivotTip().height
+}
+
+// observerGraph returns the local graph of the observer, nil if it has none.
+func (o *Oracle) observerGraph() ForkChoice {
+	miner, ok := o.miners.miners[o.options.Observer].(interface{ Graph() ForkChoice })
+	if !ok {
+		return nil
+	}
+	return miner.Graph()
+}
+
+func metrics(g ForkChoice, splitMiner0 bool) *Metrics {
+	m := &Metrics{
+		Blocks:      g.Size() - 1,
+		PivotHeight: g.PivotTip().height,
+	}
+	m.PivotRatio = ratio(m.PivotHeight, g.Size())
+
+	anti := antisets(g, antisetDepth)
+	blockCnt := make(CountMap)
+	antiSum := make(CountMap)
+	for _, block := range g.Order() {
+		if num, ok := anti[block.index]; ok {
+			blockCnt.Incur(block.minerID, 1)
+			antiSum.Incur(block.minerID, num)
+		}
+	}
+
+	size := epochSizes(g)
+	sum := 0
+	for i := 0; i < recentEpochs; i++ {
+		sum += size.Get(m.PivotHeight - i)
+	}
+	m.EpochSize = ratio(sum, recentEpochs)
+
+	if !splitMiner0 {
+		m.Antiset = ratio(antiSum.Sum(), blockCnt.Sum())
+		return m
+	}
+
+	miner0Pivot := 0
+	for pivotBlock := g.PivotTip(); pivotBlock.parent != nil; pivotBlock = pivotBlock.parent {
+		if pivotBlock.minerID == 0 {
+			miner0Pivot++
+		}
+	}
+	m.AttackerPivotShare = ratio(miner0Pivot, m.PivotHeight)
+	m.Antiset = ratio(antiSum.Sum()-antiSum[0], blockCnt.Sum()-blockCnt[0])
+	m.AttackerAntiset = ratio(antiSum[0], blockCnt[0])
+	return m
+}
+
+// epochSizes returns the number of blocks of each epoch of the total order,
+// genesis excluded.
+func epochSizes(g ForkChoice) CountMap {
+	size := make(CountMap)
+	for _, block := range g.Order() {
+		if epoch := g.Epoch(block); epoch > 0 {
+			size.Incur(epoch, 1)
+		}
+	}
+	return size
+}
+
+// antisets returns the N+c antiset size of the blocks whose epoch is at least c
+// epochs below the pivot tip: the blocks in the past of the pivot block c epochs
+// after the block, which are neither in the past nor in the future of the block.
+// A local graph caches them, see LocalGraph.antiset.
+func antisets(g ForkChoice, c int) map[int]int {
+	if g, ok := g.(*LocalGraph); ok {
+		return g.countAnti(c)
+	}
+
+	tip := g.PivotTip()
+	pivots := make([]*Block, tip.height+1)
+	for block := tip; block != nil; block = block.parent {
+		pivots[block.height] = block
+	}
+	result := make(map[int]int)
+	for _, block := range g.Order() {
+		end := g.Epoch(block) + c
+		if end > tip.height {
+			continue
+		}
+		// The ancestors of a block of an epoch are in that epoch or an earlier
+		// one, so the search for the future of the block stops at end.
+		visited := map[*Block]bool{block: true}
+		future := []*Block{block}
+		for i := 0; i < len(future); i++ {
+			for _, child := range append(future[i].children[:len(future[i].children):len(future[i].children)], future[i].refChildren...) {
+				if !visited[child] && g.Contains(child) {
+					if epoch := g.Epoch(child); epoch >= 0 && epoch <= end {
+						visited[child] = true
+						future = append(future, child)
+					}
+				}
+			}
+		}
+		result[block.index] = pivots[end].ancestorNum + 1 - (block.ancestorNum + len(future))
+	}
+	return result
+}
+
+func report_pivot(g ForkChoice) (CountMap, CountMap, CountMap) {
+	weight := g.Size()
+	pivot := g.PivotTip().height
+
+	pivotCnt := make(CountMap)
+	lastPivotCnt := make(CountMap)
+	pivotRefSum := make(CountMap)
+
+	for pivotBlock := g.PivotTip(); pivotBlock.parent != nil; pivotBlock = pivotBlock.parent {
+		pivotCnt.Incur(pivotBlock.minerID, 1)
+		pivotRefSum.Incur(pivotBlock.minerID, len(pivotBlock.references))
+	}
+
+	// For log
+	miner0Pivot := pivotCnt[0]
+
+	log.Warningf("%d(%d) pivot, %d from miner 0; ratio %.3f, %.3f;",
+		pivot, weight, miner0Pivot, float64(pivot)/float64(weight), float64(miner0Pivot)/float64(pivot))
+
+	return pivotCnt, lastPivotCnt, pivotRefSum
+}
+
+// report_anti reports the antiset size of miner 0 separately if splitMiner0 is set.
+func report_anti(g ForkChoice, c int, splitMiner0 bool) (CountMap, CountMap) {
+	anti := antisets(g, c)
+
+	blockCnt := make(CountMap)
+	antiSum := make(CountMap)
+
+	for _, block := range g.Order() {
+		if num, ok := anti[block.index]; ok {
+			blockCnt.Incur(block.minerID, 1)
+			antiSum.Incur(block.minerID, num)
+		}
+	}
+
+	if splitMiner0 {
+		log.Warningf("N+%d Antiset in recent 100 epochs, Attacker %.3f, Honest %.3f", c,
+			float64(antiSum[0])/float64(blockCnt[0]),
+			float64(antiSum.Sum()-antiSum[0])/float64(blockCnt.Sum()-blockCnt[0]))
+	} else {
+		log.Warningf("N+%d Antiset in recent 100 epochs, %.3f", c, float64(antiSum.Sum())/float64(blockCnt.Sum()))
+	}
+	return blockCnt, antiSum
+}
+
+func report_epochsize(g ForkChoice) CountMap {
+	size := epochSizes(g)
+	pivotHeight := g.PivotTip().height
+	sum := 0
+	for i := 0; i < 100; i += 1 {
+		sum += size.Get(pivotHeight - i)
+	}
+	log.Warningf("Last 100 epochs have %d blocks", sum)
+	return size
+}
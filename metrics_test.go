@@ -0,0 +1,45 @@
+package simulator
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// opaqueForkChoice hides the type of a local graph, so the metrics take their
+// generic path.
+type opaqueForkChoice struct {
+	ForkChoice
+}
+
+// TestCachedAntisets checks the antisets cached by a local graph against the
+// generic search, after every insertion of random DAGs whose pivot chain switches
+// branches, so the cache is used and invalidated.
+func TestCachedAntisets(t *testing.T) {
+	switches := 0
+	for seed := int64(1); seed <= 6; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		g := NewLocalGraph()
+		g.onPivot = func(old, new *Block) {
+			if pivotSwitched(old, new) {
+				switches++
+			}
+		}
+		randomDAG(rng, 150, 0, func(block *Block) {
+			g.Insert(block)
+			for _, c := range []int{1, 3, 10} {
+				cached, generic := g.countAnti(c), antisets(opaqueForkChoice{g}, c)
+				if len(cached) != len(generic) {
+					t.Fatalf("seed %d, block %d, c %d: %d cached antisets, %d from the search", seed, block.index, c, len(cached), len(generic))
+				}
+				for index, size := range generic {
+					if cached[index] != size {
+						t.Fatalf("seed %d, block %d, c %d: block %d has the cached antiset %d, want %d", seed, block.index, c, index, cached[index], size)
+					}
+				}
+			}
+		})
+	}
+	if switches == 0 {
+		t.Fatal("the pivot chain never switched to another branch")
+	}
+}
@@ -1,6 +1,9 @@
-package main
+package simulator
 
-import "container/list"
+import (
+	"container/list"
+	"fmt"
+)
 
 type WMinerType int
 
@@ -13,20 +16,40 @@ type WithholdMiner struct {
 	id     int
 	mType  WMinerType
 	oracle *Oracle
-	graph  *LocalGraph
+	graph  ForkChoice
 	cache  *list.List
 
-	realGraph     *LocalGraph
+	realGraph     ForkChoice
 	holdingBlock  *list.List
 	receivingTime map[int]int64
+
+	diameterSec float64 // Network diameter in seconds
+	diameter    int64
+}
+
+func init() {
+	RegisterMiner(&MinerFactory{
+		Name:  "withhold",
+		Usage: "Withholds its blocks while it owns the pivot chain",
+		Params: []Param{
+			{Name: "type", Kind: StringParam, Default: "delayRef", Choices: []string{"selfish", "delayRef"}, Usage: "Reference strategy"},
+			{Name: "diameter", Kind: FloatParam, Default: "60", Usage: "Network diameter assumed by delayRef (s)"},
+		},
+		New: func(cfg *Config, args Args) Miner {
+			mType := delayRef
+			if args.String("type") == "selfish" {
+				mType = selfish
+			}
+			return NewWithholdMiner(mType, args.Float("diameter"))
+		},
+	})
 }
 
-func NewWithholdMiner(t WMinerType) *WithholdMiner {
+func NewWithholdMiner(t WMinerType, diameter float64) *WithholdMiner {
 	return &WithholdMiner{
 		mType:         t,
-		graph:         NewLocalGraph(),
+		diameterSec:   diameter,
 		cache:         list.New(),
-		realGraph:     NewLocalGraph(),
 		holdingBlock:  list.New(),
 		receivingTime: make(map[int]int64),
 	}
@@ -35,21 +58,22 @@ func NewWithholdMiner(t WMinerType) *WithholdMiner {
 func (wm *WithholdMiner) Setup(oracle *Oracle, id int) {
 	wm.oracle = oracle
 	wm.id = id
+	wm.diameter = int64(wm.diameterSec * oracle.timePrecision)
+	wm.graph = oracle.newForkChoice(id)
+	wm.realGraph = oracle.newForkChoice(id)
+	oracle.watchGraph(wm.graph, id)
 }
 
 func (wm *WithholdMiner) GenerateBlock(block *Block) []Event {
 	// Miners can always seen the genesis block, so block.parent can't be empty
 	if wm.mType == selfish {
-		block.parent = wm.graph.pivotTip.block
-		block.parent.children = append(block.parent.children, block)
-
-		block.height = block.parent.height + 1
-		block.ancestorNum = block.parent.ancestorNum + 1
+		parent := wm.graph.PivotTip()
+		block.Link(parent, nil, parent.ancestorNum+1)
 	} else if wm.mType == delayRef {
-		wm.graph.fillNewBlock(block)
+		wm.graph.FillNewBlock(block)
 	}
 
-	wm.graph.insert(block)
+	wm.graph.Insert(block)
 
 	refs := make([]int, len(block.references))
 	for idx, ref := range block.references {
@@ -57,7 +81,7 @@ func (wm *WithholdMiner) GenerateBlock(block *Block) []Event {
 	}
 
 	log.Noticef("Time %.2f, Adv Miner mines %d, height %d, father %d, refs %v",
-		wm.oracle.getRealTime(), block.index, block.height, block.parent.index, refs)
+		wm.oracle.RealTime(), block.index, block.height, block.parent.index, refs)
 
 	wm.holdingBlock.PushBack(block)
 	return wm.checkBroadCast()
@@ -66,18 +90,19 @@ func (wm *WithholdMiner) GenerateBlock(block *Block) []Event {
 func (wm *WithholdMiner) ReceiveBlock(block *Block) []Event {
 	wm.receivingTime[block.index] = wm.oracle.timestamp
 	if block.minerID == -1 {
-		wm.realGraph.insert(block)
-		wm.graph.insert(block)
+		wm.realGraph.Insert(block)
+		wm.graph.Insert(block)
 		return []Event{}
 	}
 
-	log.Infof("Time %.2f, Adv Miner receives %d", wm.oracle.getRealTime(), block.index)
+	log.Infof("Time %.2f, Adv Miner receives %d", wm.oracle.RealTime(), block.index)
 
-	insertResult := wm.realGraph.insert(block)
+	insertResult := wm.realGraph.Insert(block)
 
 	switch insertResult {
 	case Fail:
-		log.Fatalf("block %d", block.index)
+		// The parent has not arrived yet, e.g. a delivery restored from the
+		// checkpoint of an honest miner. It is inserted from the cache later.
 		wm.cache.PushBack(block)
 		return []Event{}
 	case Existing:
@@ -97,15 +122,15 @@ func (wm *WithholdMiner) ReceiveBlock(block *Block) []Event {
 func (wm *WithholdMiner) graphInsert(block *Block) []Event {
 	switch wm.mType {
 	case selfish:
-		wm.graph.insert(block)
+		wm.graph.Insert(block)
 		return []Event{}
 	case delayRef:
-		if wm.receivingTime[block.index]+diameter/2 <= wm.oracle.timestamp {
-			wm.graph.insert(block)
+		if wm.receivingTime[block.index]+wm.diameter/2 <= wm.oracle.timestamp {
+			wm.graph.Insert(block)
 			return []Event{}
 		} else {
 			delayEvent := &DelayInsertEvent{
-				BaseEvent: BaseEvent{timestamp:wm.oracle.timestamp + diameter/2},
+				BaseEvent: BaseEvent{timestamp:wm.oracle.timestamp + wm.diameter/2},
 				block:     block,
 				m:         wm,
 			}
@@ -119,15 +144,15 @@ func (wm *WithholdMiner) graphInsert(block *Block) []Event {
 func (wm *WithholdMiner) checkBroadCast() []Event {
 	network := wm.oracle.network
 	events := make([]Event, 0)
-	for wm.realGraph.pivotTip.block.minerID != wm.id && wm.holdingBlock.Len() > 0 {
+	for wm.realGraph.PivotTip().minerID != wm.id && wm.holdingBlock.Len() > 0 {
 		e := wm.holdingBlock.Front()
 		broadcastBlock := e.Value.(*Block)
 		wm.holdingBlock.Remove(e)
 		result := network.Broadcast(wm.id, broadcastBlock)
 		events = append(events, result...)
-		wm.realGraph.insert(broadcastBlock)
+		wm.realGraph.Insert(broadcastBlock)
 		log.Noticef("Time %.2f, AdvMiner broadcast %d",
-			wm.oracle.getRealTime(), broadcastBlock.index)
+			wm.oracle.RealTime(), broadcastBlock.index)
 	}
 	return events
 }
@@ -140,9 +165,11 @@ func (wm *WithholdMiner) insertCache() []Event { // Insert blocks from cache to
 	var results []Event
 	for updated {
 		updated = false
-		for e := wm.cache.Front(); e != nil; e = e.Next() {
+		var next *list.Element
+		for e := wm.cache.Front(); e != nil; e = next {
+			next = e.Next()
 			block := e.Value.(*Block)
-			insertResult := wm.realGraph.insert(block)
+			insertResult := wm.realGraph.Insert(block)
 			if insertResult != Fail {
 				wm.cache.Remove(e)
 				if insertResult == Success {
@@ -162,6 +189,68 @@ type DelayInsertEvent struct {
 }
 
 func (e *DelayInsertEvent) Run(o *Oracle) []Event {
-	e.m.graph.insert(e.block)
+	e.m.graph.Insert(e.block)
 	return []Event{}
 }
+
+type withholdMinerState struct {
+	Graph         interface{} // See saveForkChoice
+	RealGraph     interface{}
+	Cache         []int
+	HoldingBlock  []int
+	ReceivingTime map[int]int64
+}
+
+func (wm *WithholdMiner) SaveState() (interface{}, error) {
+	graph, err := saveForkChoice(wm.graph)
+	if err != nil {
+		return nil, err
+	}
+	realGraph, err := saveForkChoice(wm.realGraph)
+	if err != nil {
+		return nil, err
+	}
+	return &withholdMinerState{
+		Graph:         graph,
+		RealGraph:     realGraph,
+		Cache:         blockList(wm.cache),
+		HoldingBlock:  blockList(wm.holdingBlock),
+		ReceivingTime: wm.receivingTime,
+	}, nil
+}
+
+// LoadState also accepts the state of an honest miner, so an honest miner can
+// turn into an attacker when a run is resumed.
+func (wm *WithholdMiner) LoadState(state interface{}) error {
+	blocks := wm.oracle.blocks
+	switch s := state.(type) {
+	case *withholdMinerState:
+		if err := wm.oracle.loadForkChoice(wm.graph, s.Graph); err != nil {
+			return err
+		}
+		if err := wm.oracle.loadForkChoice(wm.realGraph, s.RealGraph); err != nil {
+			return err
+		}
+		wm.cache = restoreBlockList(blocks, s.Cache)
+		wm.holdingBlock = restoreBlockList(blocks, s.HoldingBlock)
+		wm.receivingTime = copyTimes(s.ReceivingTime)
+	case *honestMinerState:
+		if err := wm.oracle.loadForkChoice(wm.graph, s.Graph); err != nil {
+			return err
+		}
+		if err := wm.oracle.loadForkChoice(wm.realGraph, s.Graph); err != nil {
+			return err
+		}
+		wm.cache = restoreBlockList(blocks, s.Cache)
+		wm.holdingBlock = list.New()
+		wm.receivingTime = make(map[int]int64)
+		for _, block := range blocks {
+			if wm.graph.Contains(block) {
+				wm.receivingTime[block.index], _ = block.ReceivingTime(wm.id)
+			}
+		}
+	default:
+		return fmt.Errorf("can not restore a withhold miner from %T", state)
+	}
+	return nil
+}
@@ -1,19 +1,30 @@
-package main
+package simulator
 
 import (
 	"container/list"
+	"fmt"
 )
 
 type HonestMiner struct {
 	id     int
 	oracle *Oracle
-	graph  *LocalGraph
+	graph  ForkChoice
+	rules  *clockRules
 	cache  *list.List
 }
 
+func init() {
+	RegisterMiner(&MinerFactory{
+		Name:  "honest",
+		Usage: "Follows the protocol and relays every block",
+		New: func(cfg *Config, args Args) Miner {
+			return NewHonestMiner()
+		},
+	})
+}
+
 func NewHonestMiner() *HonestMiner {
 	return &HonestMiner{
-		graph: NewLocalGraph(),
 		cache: list.New(),
 	}
 }
@@ -21,12 +32,25 @@ func NewHonestMiner() *HonestMiner {
 func (hm *HonestMiner) Setup(oracle *Oracle, id int) {
 	hm.oracle = oracle
 	hm.id = id
+	hm.graph = oracle.newForkChoice(id)
+	hm.rules = oracle.newClockRules(id)
+	oracle.watchGraph(hm.graph, id)
+}
+
+func (hm *HonestMiner) Graph() ForkChoice {
+	return hm.graph
 }
 
 func (hm *HonestMiner) GenerateBlock(block *Block) []Event {
 	// Miners can always seen the genesis block, so block.parent can't be empty
-	hm.graph.fillNewBlock(block)
-	hm.graph.insert(block)
+	hm.graph.FillNewBlock(block)
+	hm.rules.stamp(block)
+	return hm.publish(block)
+}
+
+// publish inserts a new block and broadcasts it.
+func (hm *HonestMiner) publish(block *Block) []Event {
+	hm.rules.insert(hm.graph, block)
 
 	// For Log
 	refs := make([]int, len(block.references))
@@ -34,7 +58,7 @@ func (hm *HonestMiner) GenerateBlock(block *Block) []Event {
 		refs[idx] = ref.index
 	}
 	log.Infof("Time %.2f, Miner %d mines block %d, height %d, father %d, refs %v",
-			hm.oracle.getRealTime(), hm.id, block.index, block.height, block.parent.index, refs)
+			hm.oracle.RealTime(), hm.id, block.index, block.height, block.parent.index, refs)
 
 	network := hm.oracle.network
 	events := network.Broadcast(hm.id, block)
@@ -47,46 +71,83 @@ func (hm *HonestMiner) ReceiveBlock(block *Block) []Event {
 	events := make([]Event, 0)
 
 	if hm.id == 0 {
-		log.Infof("Time %.2f, Miner %d receives %d (miner %d)", hm.oracle.getRealTime(), hm.id, block.index, block.minerID)
+		log.Infof("Time %.2f, Miner %d receives %d (miner %d)", hm.oracle.realTimeAt(hm.id), hm.id, block.index, block.minerID)
 	}
 
-	insertResult := hm.graph.insert(block)
+	insertResult := hm.rules.insert(hm.graph, block)
 
 	if insertResult == Success {
 		results1 := network.Relay(hm.id, block)
 		events = append(events, results1...)
 
-		cacheBlocks := hm.insertCache()
+		cacheBlocks, deferred := hm.insertCache()
 		for _, cacheBlock := range cacheBlocks {
 			cacheResult := network.Relay(hm.id, cacheBlock)
 			events = append(events, cacheResult...)
 		}
+		events = append(events, deferred...)
 	} else if insertResult == Fail { // If there are ancestorNum haven't been received, put block to cache.
 		hm.cache.PushBack(block)
+	} else if insertResult == Future {
+		events = append(events, hm.oracle.deferBlock(block, hm.id, hm.rules.maxFuture))
+	} else if insertResult == Invalid {
+		log.Infof("Time %.2f, Miner %d rejects block %d, timestamp %.2f", hm.oracle.realTimeAt(hm.id), hm.id, block.index, float64(block.timestamp)/hm.oracle.timePrecision)
 	}
 	return events
 }
 
-func (hm *HonestMiner) insertCache() []*Block { // Insert blocks from cache to local graph
+// insertCache inserts blocks from cache to local graph. It also returns the
+// deliveries of the blocks deferred by the timestamp rules.
+func (hm *HonestMiner) insertCache() ([]*Block, []Event) {
 	results := make([]*Block, 0)
+	var deferred []Event
 
 	if hm.cache.Len() == 0 {
-		return results
+		return results, deferred
 	}
 	updated := true
 	for updated {
 		updated = false
-		for e := hm.cache.Front(); e != nil; e = e.Next() {
+		var next *list.Element
+		for e := hm.cache.Front(); e != nil; e = next {
+			next = e.Next()
 			block := e.Value.(*Block)
-			insertResult := hm.graph.insert(block)
+			insertResult := hm.rules.insert(hm.graph, block)
 			if insertResult != Fail {
 				hm.cache.Remove(e)
 				if insertResult == Success {
 					results = append(results, block)
 					updated = true
+				} else if insertResult == Future {
+					deferred = append(deferred, hm.oracle.deferBlock(block, hm.id, hm.rules.maxFuture))
 				}
 			}
 		}
 	}
-	return results
+	return results, deferred
+}
+
+type honestMinerState struct {
+	Graph interface{} // See saveForkChoice
+	Cache []int
+}
+
+func (hm *HonestMiner) SaveState() (interface{}, error) {
+	graph, err := saveForkChoice(hm.graph)
+	if err != nil {
+		return nil, err
+	}
+	return &honestMinerState{Graph: graph, Cache: blockList(hm.cache)}, nil
+}
+
+func (hm *HonestMiner) LoadState(state interface{}) error {
+	s, ok := state.(*honestMinerState)
+	if !ok {
+		return fmt.Errorf("can not restore an honest miner from %T", state)
+	}
+	if err := hm.oracle.loadForkChoice(hm.graph, s.Graph); err != nil {
+		return err
+	}
+	hm.cache = restoreBlockList(hm.oracle.blocks, s.Cache)
+	return nil
 }
@@ -0,0 +1,29 @@
+package simulator
+
+import (
+	"container/list"
+	"testing"
+)
+
+// TestInsertCacheAfterRemoval checks that the cache is scanned past a block
+// dropped by the timestamp rules, so the blocks behind it are inserted.
+func TestInsertCacheAfterRemoval(t *testing.T) {
+	graph := NewLocalGraph()
+	genesis := &Block{index: 0, minerID: -1, timestamp: 10}
+	graph.Insert(genesis)
+	invalid := &Block{index: 1, timestamp: 5}
+	valid := &Block{index: 2, timestamp: 20}
+	graph.FillNewBlock(invalid)
+	graph.FillNewBlock(valid)
+
+	hm := &HonestMiner{graph: graph, rules: &clockRules{medianPast: 1}, cache: list.New()}
+	hm.cache.PushBack(invalid)
+	hm.cache.PushBack(valid)
+	results, _ := hm.insertCache()
+	if len(results) != 1 || results[0] != valid {
+		t.Fatalf("inserted %d blocks from the cache, want block %d", len(results), valid.index)
+	}
+	if hm.cache.Len() != 0 || graph.Contains(invalid) {
+		t.Fatalf("%d blocks left in the cache, invalid block inserted: %v", hm.cache.Len(), graph.Contains(invalid))
+	}
+}
@@ -0,0 +1,43 @@
+package simulator
+
+// TimewarpMiner follows the protocol but reports the lowest valid timestamp for
+// its blocks, and a timestamp far in the future for the blocks closing a retarget
+// window. A Bitcoin retarget then measures a longer window than the real one
+// and lowers the difficulty.
+type TimewarpMiner struct {
+	*HonestMiner
+	window int
+	future float64 // Seconds
+}
+
+func init() {
+	RegisterMiner(&MinerFactory{
+		Name:  "timewarp",
+		Usage: "Manipulates the timestamps of its blocks to lower the difficulty",
+		Params: []Param{
+			{Name: "window", Kind: IntParam, Default: "2016", Usage: "Retarget window of the difficulty (pivot blocks)"},
+			{Name: "future", Kind: FloatParam, Default: "0", Usage: "Lead of the timestamp closing a window (s), 0 for the maximum of the clock rules"},
+		},
+		New: func(cfg *Config, args Args) Miner {
+			future := args.Float("future")
+			if future == 0 {
+				future = cfg.Clock.MaxFuture
+			}
+			return NewTimewarpMiner(args.Int("window"), future)
+		},
+	})
+}
+
+func NewTimewarpMiner(window int, future float64) *TimewarpMiner {
+	return &TimewarpMiner{HonestMiner: NewHonestMiner(), window: window, future: future}
+}
+
+func (tm *TimewarpMiner) GenerateBlock(block *Block) []Event {
+	tm.graph.FillNewBlock(block)
+	if block.height%tm.window == 0 {
+		block.timestamp = tm.oracle.LocalTime(tm.id) + int64(tm.future*tm.oracle.timePrecision)
+	} else if tm.rules.medianPast > 0 {
+		block.timestamp = tm.rules.medianTime(block.parent) + 1
+	}
+	return tm.publish(block)
+}
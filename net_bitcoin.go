@@ -1,7 +1,7 @@
-package main
+package simulator
 
 import (
-	"math/rand"
+	"fmt"
 	"sort"
 )
 
@@ -11,28 +11,95 @@ type BitcoinNetwork struct {
 
 	peers    map[int][]int
 	nextTime map[int]int64 // Deprecate Code for FIFO model
-	inFlight map[int]*Set
-	sent     map[int]*Set
+	inFlight *nodeSets     // Nodes which have or are requesting a block
+	sent     *nodeSets     // Nodes which have relayed a block
 	geo      map[int]int
 
-	attacker   *Set
-	verifyTime float64
-	relayImpl  int
+	attacker       *Set
+	verifyTime     float64
+	requestTimeout float64 // Seconds, 0 to wait for every request forever
+	requests       map[requestKey]*blockRequest
+	relayImpl      int
+	blockSize      float64
+	peerNum        int
+	localRatio     float64
 }
 
-func NewBitcoinNetwork(attacker bool) *BitcoinNetwork {
+func init() {
+	RegisterNetwork(&NetworkFactory{
+		Name:  "bitcoin",
+		Usage: "Bitcoin-like INV/GETDATA relay with geographic delay and bandwidth limit",
+		Params: []Param{
+			{Name: "verifyTime", Kind: FloatParam, Default: "0.3", Usage: "Block verification time before relay (s)"},
+			{Name: "relay", Kind: StringParam, Default: "full", Choices: []string{"full", "compact"}, Usage: "Block relay implementation"},
+			{Name: "requestTimeout", Kind: FloatParam, Default: "0", Usage: "Seconds before a block request is sent to another peer which announced the block, 0 to disable"},
+		},
+		New: func(cfg *Config, args Args) Network {
+			relayImpl := 0
+			if args.String("relay") == "compact" {
+				relayImpl = 1
+			}
+			return NewBitcoinNetwork(BitcoinNetworkOptions{
+				BlockSize:      cfg.BlockSize,
+				Bandwidth:      cfg.Network.Bandwidth,
+				BufferSize:     cfg.Network.BufferSize,
+				Peers:          cfg.Network.Peers,
+				LocalRatio:     cfg.Network.LocalRatio,
+				VerifyTime:     args.Float("verifyTime"),
+				RequestTimeout: args.Float("requestTimeout"),
+				RelayImpl:      relayImpl,
+				Attacker:       cfg.Attacker.Enabled,
+				Monopoly:       cfg.Attacker.Monopoly,
+			})
+		},
+	})
+}
+
+type BitcoinNetworkOptions struct {
+	BlockSize  float64 // MB
+	Bandwidth  float64 // Mbps
+	BufferSize float64 // MB socket buffer
+	Peers      int
+	LocalRatio float64 // Ratio of peers in the same region
+	VerifyTime float64 // Block verification time before relay (s)
+	RelayImpl  int     // 0 for full blocks, 1 for compact blocks
+	Attacker   bool    // Miner 0 is an attacker with express links
+	Monopoly   bool    // Miner 0 has a 500 Mbps uplink
+
+	// A block request not answered in RequestTimeout seconds is cancelled and
+	// sent to the next peer which announced the block. 0 disables the timeout.
+	RequestTimeout float64
+}
+
+func DefaultBitcoinNetworkOptions() BitcoinNetworkOptions {
+	return BitcoinNetworkOptions{
+		BlockSize:  4,
+		Bandwidth:  20,
+		BufferSize: 32,
+		Peers:      10,
+		LocalRatio: 0.05,
+		VerifyTime: 0.3,
+	}
+}
+
+func NewBitcoinNetwork(options BitcoinNetworkOptions) *BitcoinNetwork {
 	isAttacker := NewSet()
-	if attacker {
+	if options.Attacker {
 		isAttacker.Add(0)
 	}
 
 	network := &BitcoinNetwork{
-		verifyTime: 0.3,
-
-		attacker:  isAttacker,
-		relayImpl: 0,
+		verifyTime:     options.VerifyTime,
+		requestTimeout: options.RequestTimeout,
+		requests:       make(map[requestKey]*blockRequest),
+
+		attacker:   isAttacker,
+		relayImpl:  options.RelayImpl,
+		blockSize:  options.BlockSize,
+		peerNum:    options.Peers,
+		localRatio: options.LocalRatio,
 	}
-	network.traffic = NewTraffic(network)
+	network.traffic = NewTraffic(network, options.Bandwidth, options.BufferSize, options.Monopoly)
 	return network
 }
 
@@ -42,17 +109,13 @@ func (bn *BitcoinNetwork) Setup(o *Oracle) {
 	N := len(o.miners.miners)
 
 	peer := make(map[int][]int)
-	sent := make(map[int]*Set)
 	nextTime := make(map[int]int64)
-	inFlight := make(map[int]*Set)
 	geo := make(map[int]int)
 
 	for i := 0; i < N; i++ {
 		peer[i] = make([]int, 0)
-		sent[i] = NewSet()
-		inFlight[i] = NewSet()
 		nextTime[i] = 0
-		geo[i] = rand.Intn(geoN)
+		geo[i] = o.rand.Geo.Intn(geoN)
 	}
 
 	// randomly set up peer connections, but should has the same order after replaying the simulation
@@ -61,12 +124,12 @@ func (bn *BitcoinNetwork) Setup(o *Oracle) {
 		for _, p := range peer[i] {
 			set.Add(p)
 		}
-		for j := 0; j < peers_/2; j++ {
+		for j := 0; j < bn.peerNum/2; j++ {
 			for {
-				end := int(rand.Int31n(int32(N)))
+				end := int(o.rand.Topology.Int31n(int32(N)))
 				if !set.Has(end) {
 					invN := float64(1.0 / float64(geoN))
-					if geo[i] == geo[end] || rand.Float64() < (invN*(1-localRatio_)/localRatio_)/(1-invN) {
+					if geo[i] == geo[end] || o.rand.Topology.Float64() < (invN*(1-bn.localRatio)/bn.localRatio)/(1-invN) {
 						set.Add(end)
 						break
 					}
@@ -77,7 +140,7 @@ func (bn *BitcoinNetwork) Setup(o *Oracle) {
 		// change set to array, so iteration returns the same order
 		list := set.List()
 		sort.Ints(list)
-		rand.Shuffle(len(list), func(i, j int) {
+		o.rand.Topology.Shuffle(len(list), func(i, j int) {
 			list[i], list[j] = list[j], list[i]
 		})
 		for _, p := range list {
@@ -88,15 +151,15 @@ func (bn *BitcoinNetwork) Setup(o *Oracle) {
 
 	bn.oracle = o
 	bn.peers = peer
-	bn.sent = sent
-	bn.inFlight = inFlight
+	bn.sent = newNodeSets(N)
+	bn.inFlight = newNodeSets(N)
 	bn.nextTime = nextTime
 	bn.geo = geo
 }
 
 func (bn *BitcoinNetwork) Broadcast(senderID int, block *Block) []Event {
-	bn.sent[senderID].Add(block.index)
-	bn.inFlight[senderID].Add(block.index)
+	bn.add(bn.sent, block, senderID)
+	bn.add(bn.inFlight, block, senderID)
 
 	attackerRelay := []Event{}
 	if bn.attacker.Has(block.minerID) {
@@ -104,50 +167,76 @@ func (bn *BitcoinNetwork) Broadcast(senderID int, block *Block) []Event {
 	}
 	attackerRelay = append(attackerRelay, bn.expressRelay(block)...)
 
-	if _, ok := block.receivingTime[senderID]; !ok {
-		block.receivingTime[senderID] = bn.oracle.timestamp
-	}
+	bn.receive(senderID, block, false)
 
 	return append(bn.sendToAllPeer(senderID, block), attackerRelay...)
 }
 
 func (bn *BitcoinNetwork) Relay(senderID int, block *Block) []Event {
-	bn.sent[senderID].Add(block.index)
-	bn.inFlight[senderID].Add(block.index)
-
-	//For log and statistic, Network delay
-	if _, ok := block.receivingTime[senderID]; !ok {
-		block.receivingTime[senderID] = bn.oracle.timestamp
-
-		n := len(bn.oracle.miners.miners)
-		if len(block.receivingTime) == n {
-			start := block.receivingTime[block.minerID]
-			var sum int64
-			sum = 0
-			for _, item := range block.receivingTime {
-				sum += item - start
-			}
-			avg := float64(sum) / float64(n)
-			max := float64(bn.oracle.timestamp - start)
+	bn.add(bn.sent, block, senderID)
+	bn.add(bn.inFlight, block, senderID)
 
-			if block.index%5 == 0 {
-				log.Warningf("Block %d miner %d, Avg time %0.2f, Max time %0.2f", block.index, block.minerID, avg/bn.oracle.timePrecision, max/bn.oracle.timePrecision)
-			} else {
-				log.Noticef("Block %d miner %d, Avg time %0.2f, Max time %0.2f", block.index, block.minerID, avg/bn.oracle.timePrecision, max/bn.oracle.timePrecision)
-			}
-		}
-	}
+	bn.receive(senderID, block, true)
 
 	return bn.sendToAllPeer(senderID, block)
 }
 
+// add puts a node in the set of a block. The count of the set is shared by the
+// nodes, so it is updated at the commit of a parallel window.
+func (bn *BitcoinNetwork) add(set *nodeSets, block *Block, node int) {
+	if !set.mark(block.index, node) {
+		return
+	}
+	if p := bn.oracle.windowPartition(node); p != nil {
+		p.atCommit(func() {
+			set.tally(block.index)
+		})
+		return
+	}
+	set.tally(block.index)
+}
+
+// receive records the time a node has the block. If report is set, the network
+// delay of the block is logged once every node has it.
+func (bn *BitcoinNetwork) receive(node int, block *Block, report bool) {
+	o := bn.oracle
+	now := o.now(node)
+	if !block.receive(node, now, len(o.miners.miners)) {
+		return
+	}
+	if p := o.windowPartition(node); p != nil {
+		p.atCommit(func() {
+			bn.countReceived(node, block, now, report)
+		})
+		return
+	}
+	bn.countReceived(node, block, now, report)
+}
+
+func (bn *BitcoinNetwork) countReceived(node int, block *Block, now int64, report bool) {
+	o := bn.oracle
+	n := len(o.miners.miners)
+	if !block.countReceived(node, now, n) || !report {
+		return
+	}
+	start := block.minerTime
+	avg := float64(block.receivedSum-int64(n)*start) / float64(n)
+	max := float64(now - start)
+
+	if block.index%5 == 0 {
+		log.Warningf("Block %d miner %d, Avg time %0.2f, Max time %0.2f", block.index, block.minerID, avg/o.timePrecision, max/o.timePrecision)
+	} else {
+		log.Noticef("Block %d miner %d, Avg time %0.2f, Max time %0.2f", block.index, block.minerID, avg/o.timePrecision, max/o.timePrecision)
+	}
+}
+
 func (bn *BitcoinNetwork) sendToAllPeer(senderID int, block *Block) []Event {
 	if bn.attacker.Has(senderID) {
 		return []Event{}
 	}
 
 	results := make([]Event, 0)
-	startTime := int64(bn.oracle.timePrecision*bn.verifyTime) + bn.oracle.timestamp
+	startTime := int64(bn.oracle.timePrecision*bn.verifyTime) + bn.oracle.now(senderID)
 
 	for _, receiverID := range bn.peers[senderID] {
 		sendINV := &INVPacketEvent{
@@ -178,8 +267,8 @@ func (bn *BitcoinNetwork) expressRelay(block *Block) []Event {
 			block:      block,
 		}
 		//log.Criticalf("express block %d", block.index)
-		bn.sent[attacker].Add(block.index)
-		bn.inFlight[attacker].Add(block.index)
+		bn.add(bn.sent, block, attacker)
+		bn.add(bn.inFlight, block, attacker)
 		result = append(result, sendEvent)
 	}
 	return result
@@ -196,13 +285,27 @@ func (bn *BitcoinNetwork) expressBroadcast(block *Block) []Event {
 			receiverID: receiver,
 			block:      block,
 		}
-		bn.sent[receiver].Add(block.index)
-		bn.inFlight[receiver].Add(block.index)
+		bn.add(bn.sent, block, receiver)
+		bn.add(bn.inFlight, block, receiver)
 		result = append(result, sendEvent)
 	}
 	return result
 }
 
+// lookahead returns the least delay of an event a node schedules for another
+// node, in time slots: a block is announced after its verification, and the
+// other packets take at least the ping of a link without jitter.
+func (bn *BitcoinNetwork) lookahead() int64 {
+	o := bn.oracle
+	least := int64(o.timePrecision * bn.verifyTime)
+	for i, peers := range bn.peers {
+		for _, p := range peers {
+			least = min(least, int64(geodelay[bn.geo[i]][bn.geo[p]]*0.9/1000*o.timePrecision))
+		}
+	}
+	return least
+}
+
 type INVPacketEvent struct {
 	PacketEvent
 	blockID int
@@ -210,72 +313,196 @@ type INVPacketEvent struct {
 
 func (e *INVPacketEvent) Sent(o *Oracle) []Event {
 	network := e.network
-	if network.inFlight[e.receiverID].Has(e.blockID) {
+	if network.inFlight.Has(e.blockID, e.receiverID) {
+		if request, ok := network.requests[requestKey{e.receiverID, e.blockID}]; ok {
+			request.peers = append(request.peers, e.senderID)
+		}
 		return []Event{}
 	}
 
-	if o.blocks[e.blockID].minerID == 0 && hasAttacker_ {
+	if network.attacker.Has(o.blocks[e.blockID].minerID) {
 		log.Criticalf("error %d at %d", e.blockID, e.receiverID)
 	}
 
-	result := []Event{}
-	switch network.relayImpl {
+	network.add(network.inFlight, o.blocks[e.blockID], e.receiverID)
+	return network.request(e.senderID, e.receiverID, o.blocks[e.blockID])
+}
+
+// request makes receiverID ask senderID for a block it has announced, and
+// schedules the timeout of the request if it is enabled.
+func (bn *BitcoinNetwork) request(senderID int, receiverID int, block *Block) []Event {
+	o := bn.oracle
+	now := o.now(receiverID)
+	var packet Event
+	switch bn.relayImpl {
 	case 0:
 		getData := &GETPacketEvent{
 			PacketEvent: PacketEvent{
-				senderID:   e.senderID,
-				receiverID: e.receiverID,
-				network:    e.network,
-				size:       int64(blockSize_ * mb),
+				senderID:   senderID,
+				receiverID: receiverID,
+				network:    bn,
+				size:       int64(bn.blockSize * mb),
 			},
-			block: o.blocks[e.blockID],
+			block: block,
 		}
 		getData.childPointer = getData
 
 		if getData.senderID == 0 {
-			log.Infof("Time %0.2f, Miner %d request %d", o.getRealTime(), e.receiverID, e.blockID)
+			log.Infof("Time %0.2f, Miner %d request %d", o.realTimeAt(receiverID), receiverID, block.index)
 		}
 
-		getData.prepare(o.timestamp + 2*e.pingDelay())
-		network.inFlight[e.receiverID].Add(e.blockID)
-		result = append(result, getData)
+		getData.prepare(now)
+		o.delay(receiverID, getData, now, 2, &getData.PacketEvent)
+		packet = getData
 	case 1:
 		getData := &GETCompactPacketEvent{
 			PacketEvent: PacketEvent{
-				senderID:   e.senderID,
-				receiverID: e.receiverID,
-				network:    e.network,
-				size:       int64(blockSize_ * mb / 50),
+				senderID:   senderID,
+				receiverID: receiverID,
+				network:    bn,
+				size:       int64(bn.blockSize * mb / 50),
 			},
-			block: o.blocks[e.blockID],
+			block: block,
 		}
 		getData.childPointer = getData
 
-		log.Noticef("Time %0.2f, Miner %d request %d", o.getRealTime(), e.receiverID, e.blockID)
+		log.Noticef("Time %0.2f, Miner %d request %d", o.realTimeAt(receiverID), receiverID, block.index)
+
+		getData.prepare(now)
+		o.delay(receiverID, getData, now, 2, &getData.PacketEvent)
+		packet = getData
+	}
 
-		getData.prepare(o.timestamp + 2*e.pingDelay())
-		network.inFlight[e.receiverID].Add(e.blockID)
-		result = append(result, getData)
+	result := []Event{packet}
+	if bn.requestTimeout > 0 {
+		key := requestKey{receiverID, block.index}
+		request, ok := bn.requests[key]
+		if !ok {
+			request = &blockRequest{}
+			bn.requests[key] = request
+		}
+		timeout := &RequestTimeoutEvent{
+			BaseEvent: BaseEvent{timestamp: now + int64(bn.requestTimeout*o.timePrecision)},
+			network:   bn,
+			key:       key,
+		}
+		request.sender = senderID
+		request.packets = append(request.packets, NewCancelToken(packet))
+		request.timeout = NewCancelToken(timeout)
+		result = append(result, timeout)
 	}
 	return result
 }
 
+// answered is called when a requested block has been sent, it cancels the
+// timeout of the request.
+func (bn *BitcoinNetwork) answered(senderID int, receiverID int, block *Block) {
+	key := requestKey{receiverID, block.index}
+	request, ok := bn.requests[key]
+	if !ok || request.sender != senderID {
+		return
+	}
+	request.timeout.Cancel(bn.oracle)
+	delete(bn.requests, key)
+}
+
+type requestKey struct {
+	receiver int
+	block    int
+}
+
+// blockRequest is a block request waiting for an answer.
+type blockRequest struct {
+	sender  int            // The peer asked for the block
+	peers   []int          // The other peers which have announced the block, in order
+	packets []*CancelToken // The GET packets sent by the peer for the request
+	timeout *CancelToken   // nil after a checkpoint, until the timeout event is restored
+}
+
+// trackPacket keeps a token for a GET packet of a pending request, so the
+// packet is called off if the request times out.
+func (bn *BitcoinNetwork) trackPacket(packet Event, senderID int, receiverID int, block *Block) {
+	request, ok := bn.requests[requestKey{receiverID, block.index}]
+	if ok && request.sender == senderID {
+		request.packets = append(request.packets, NewCancelToken(packet))
+	}
+}
+
+// RequestTimeoutEvent cancels a block request which has not been answered in
+// time, and asks the next peer which has announced the block. If there is none,
+// the block is requested again on the next announcement.
+type RequestTimeoutEvent struct {
+	BaseEvent
+	network *BitcoinNetwork
+	key     requestKey
+}
+
+func (e *RequestTimeoutEvent) Run(o *Oracle) []Event {
+	bn := e.network
+	request, ok := bn.requests[e.key]
+	if !ok {
+		return []Event{}
+	}
+	log.Infof("Time %0.2f, Miner %d cancels the request of block %d to miner %d", o.RealTime(), e.key.receiver, e.key.block, request.sender)
+
+	result := bn.cancelRequest(request)
+	if len(request.peers) == 0 {
+		delete(bn.requests, e.key)
+		bn.inFlight.Remove(e.key.block, e.key.receiver)
+		return result
+	}
+	next := request.peers[0]
+	request.peers = request.peers[1:]
+	return append(result, bn.request(next, e.key.receiver, o.blocks[e.key.block])...)
+}
+
+// cancelRequest calls off the GET packets of a request, wherever they are: in the
+// uplink of the sender or in the event queue.
+func (bn *BitcoinNetwork) cancelRequest(request *blockRequest) []Event {
+	result := []Event{}
+	for _, token := range request.packets {
+		result = append(result, bn.cancelPacket(token)...)
+	}
+	request.packets = nil
+	return result
+}
+
+// cancelPacket calls off a GET packet. It is queued either as itself, before it
+// enters the uplink, or as its embedded *PacketEvent, which shares its BaseEvent,
+// so the token cancels both.
+func (bn *BitcoinNetwork) cancelPacket(token *CancelToken) []Event {
+	var packet *PacketEvent
+	switch e := token.event.(type) {
+	case *GETPacketEvent:
+		packet = &e.PacketEvent
+	case *GETCompactPacketEvent:
+		packet = &e.PacketEvent
+	default:
+		return nil
+	}
+	if found, effects := bn.traffic.remove(packet); found {
+		packet.cancelled = true
+		token.event = nil
+		return effects
+	}
+	token.Cancel(bn.oracle)
+	return nil
+}
+
 type GETPacketEvent struct {
 	PacketEvent
 	block *Block
 }
 
 func (e *GETPacketEvent) Sent(o *Oracle) []Event {
-	receiveEvent := &SendBlockEvent{
-		BaseEvent:  BaseEvent{timestamp: e.timestamp + e.pingDelay()},
-		block:      e.block,
-		receiverID: e.receiverID,
-	}
+	e.network.answered(e.senderID, e.receiverID, e.block)
+	receiveEvent := NewSendBlockEvent(0, e.block, e.receiverID)
+	o.delay(e.receiverID, receiveEvent, e.timestamp, 1, &e.PacketEvent)
 	if e.receiverID == 0 {
 		log.Debugf("Relay block %d", e.block.index)
 	}
 	if e.senderID == 0 {
-		log.Debugf("Time %0.2f, Miner %d get block %d", float64(o.timestamp)/timePrecision, e.receiverID, e.block.index)
+		log.Debugf("Time %0.2f, Miner %d get block %d", o.realTimeAt(e.receiverID), e.receiverID, e.block.index)
 	}
 	return []Event{receiveEvent}
 }
@@ -291,12 +518,15 @@ func (e *GETCompactPacketEvent) Sent(o *Oracle) []Event {
 			senderID:   e.senderID,
 			receiverID: e.receiverID,
 			network:    e.network,
-			size:       int64(blockSize_ * mb),
+			size:       int64(e.network.blockSize * mb),
 		},
 		block: e.block,
 	}
 	receiveEvent.childPointer = receiveEvent
-	receiveEvent.prepare(o.timestamp + 2*e.pingDelay())
+	e.network.trackPacket(receiveEvent, e.senderID, e.receiverID, e.block)
+	now := o.now(e.receiverID)
+	receiveEvent.prepare(now)
+	o.delay(e.receiverID, receiveEvent, now, 2, &e.PacketEvent)
 	if e.receiverID == 0 {
 		log.Debugf("Relay block %d", e.block.index)
 	}
@@ -305,3 +535,81 @@ func (e *GETCompactPacketEvent) Sent(o *Oracle) []Event {
 	}
 	return []Event{receiveEvent}
 }
+
+type bitcoinNetworkState struct {
+	Peers    [][]int
+	Sent     *nodeSetsState
+	InFlight *nodeSetsState
+	Geo      []int
+	Traffic  []*nodeOutboundState
+	Requests []*requestState
+}
+
+type requestState struct {
+	Receiver int
+	Block    int
+	Sender   int
+	Peers    []int
+}
+
+func (bn *BitcoinNetwork) SaveState() (interface{}, error) {
+	n := len(bn.oracle.miners.miners)
+	state := &bitcoinNetworkState{
+		Peers:    make([][]int, n),
+		Sent:     bn.sent.saveState(),
+		InFlight: bn.inFlight.saveState(),
+		Geo:      make([]int, n),
+	}
+	for i := 0; i < n; i++ {
+		state.Peers[i] = bn.peers[i]
+		state.Geo[i] = bn.geo[i]
+	}
+	traffic, err := bn.traffic.saveState()
+	if err != nil {
+		return nil, err
+	}
+	state.Traffic = traffic
+
+	keys := make([]requestKey, 0, len(bn.requests))
+	for key := range bn.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].receiver != keys[j].receiver {
+			return keys[i].receiver < keys[j].receiver
+		}
+		return keys[i].block < keys[j].block
+	})
+	for _, key := range keys {
+		request := bn.requests[key]
+		state.Requests = append(state.Requests, &requestState{Receiver: key.receiver, Block: key.block, Sender: request.sender, Peers: request.peers})
+	}
+	return state, nil
+}
+
+// LoadState keeps the topology of the checkpoint, even if the number of peers
+// has been changed.
+func (bn *BitcoinNetwork) LoadState(state interface{}) error {
+	s, ok := state.(*bitcoinNetworkState)
+	if !ok {
+		return fmt.Errorf("can not restore a bitcoin network from %T", state)
+	}
+	if len(s.Peers) != len(bn.oracle.miners.miners) {
+		return fmt.Errorf("checkpoint has %d nodes, network has %d", len(s.Peers), len(bn.oracle.miners.miners))
+	}
+	for i := range s.Peers {
+		bn.peers[i] = s.Peers[i]
+		bn.geo[i] = s.Geo[i]
+	}
+	bn.sent.loadState(s.Sent)
+	bn.inFlight.loadState(s.InFlight)
+
+	// The packets and the timeouts are linked when the uplinks and the event
+	// queue are restored.
+	bn.requests = make(map[requestKey]*blockRequest)
+	for _, r := range s.Requests {
+		bn.requests[requestKey{r.Receiver, r.Block}] = &blockRequest{sender: r.Sender, peers: r.Peers}
+	}
+	bn.traffic.loadState(s.Traffic)
+	return nil
+}
@@ -1,15 +1,16 @@
-package main
+package simulator
 
 import (
+	"fmt"
 	"sort"
-	"math/rand"
 )
 
 type PeerNetwork struct {
 	oracle *Oracle
 
-	sent     map[int]*Set
+	sent     *nodeSets // Nodes which have been sent a block
 	peer     map[int][]int
+	peers    int
 	NET_TIME []float64
 
 	blockSize     float64
@@ -24,20 +25,54 @@ type PeerNetwork struct {
 	endTime   map[int]int64
 }
 
-func NewPeerNetwork(attacker bool) *PeerNetwork {
+func init() {
+	RegisterNetwork(&NetworkFactory{
+		Name:  "peer",
+		Usage: "Peer to peer network with limited neighbors and bandwidth",
+		Params: []Param{
+			{Name: "globalLatency", Kind: FloatParam, Default: "0.3", Usage: "Latency between peers (s)"},
+			{Name: "attackerIn", Kind: FloatParam, Default: "2", Usage: "Express delay to the attacker, negative to disable (s)"},
+			{Name: "attackerOut", Kind: FloatParam, Default: "2", Usage: "Express delay from the attacker, negative to disable (s)"},
+		},
+		New: func(cfg *Config, args Args) Network {
+			return NewPeerNetwork(PeerNetworkOptions{
+				BlockSize:     cfg.BlockSize,
+				Bandwidth:     cfg.Network.Bandwidth,
+				Peers:         cfg.Network.Peers,
+				GlobalLatency: args.Float("globalLatency"),
+				AttackerIn:    args.Float("attackerIn"),
+				AttackerOut:   args.Float("attackerOut"),
+				Attacker:      cfg.Attacker.Enabled,
+			})
+		},
+	})
+}
+
+type PeerNetworkOptions struct {
+	BlockSize     float64 // MB
+	Bandwidth     float64 // Mbps
+	Peers         int
+	GlobalLatency float64 // Latency between peers (s)
+	AttackerIn    float64 // Express delay to the attacker, negative to disable (s)
+	AttackerOut   float64 // Express delay from the attacker, negative to disable (s)
+	Attacker      bool    // Miner 0 is an attacker
+}
+
+func NewPeerNetwork(options PeerNetworkOptions) *PeerNetwork {
 	isAttacker := NewSet()
-	if attacker {
+	if options.Attacker {
 		isAttacker.Add(0)
 	}
 
 	return &PeerNetwork{
-		blockSize:     blockSize_,
-		globalLatency: globalLatency,
-		bandwidth:     bandwidth_,
+		blockSize:     options.BlockSize,
+		globalLatency: options.GlobalLatency,
+		bandwidth:     options.Bandwidth,
+		peers:         options.Peers,
 
 		attacker:    isAttacker,
-		attackerIn:  attackerIn,
-		attackerOut: attackerOut,
+		attackerIn:  options.AttackerIn,
+		attackerOut: options.AttackerOut,
 
 		startTime: make(map[int]int64),
 		endTime:   make(map[int]int64),
@@ -50,11 +85,9 @@ func (pn *PeerNetwork) Setup(o *Oracle) {
 	N := len(o.miners.miners)
 
 	peer := make(map[int][]int)
-	sent := make(map[int]*Set)
 
 	for i := 0; i < N; i++ {
 		peer[i] = make([]int, 0)
-		sent[i] = NewSet()
 	}
 
 	// randomly set up peer connections, but should has the same order after replaying the simulation
@@ -63,9 +96,9 @@ func (pn *PeerNetwork) Setup(o *Oracle) {
 		for _, p := range peer[i] {
 			set.Add(p)
 		}
-		for j := 0; j < peers_-len(peer[i]); j++ {
+		for j := 0; j < pn.peers-len(peer[i]); j++ {
 			for {
-				end := int(rand.Int31n(int32(N)))
+				end := int(o.rand.Topology.Int31n(int32(N)))
 				if !set.Has(end) {
 					set.Add(end)
 					break
@@ -76,7 +109,7 @@ func (pn *PeerNetwork) Setup(o *Oracle) {
 		// change set to array, so iteration returns the same order
 		list := set.List()
 		sort.Ints(list)
-		rand.Shuffle(len(list), func(i, j int) {
+		o.rand.Topology.Shuffle(len(list), func(i, j int) {
 			list[i], list[j] = list[j], list[i]
 		})
 		for _, p := range list {
@@ -90,7 +123,7 @@ func (pn *PeerNetwork) Setup(o *Oracle) {
 	pn.oracle = o
 	pn.NET_TIME = make([]float64, N)
 	pn.peer = peer
-	pn.sent = sent
+	pn.sent = newNodeSets(N)
 }
 
 func (pn *PeerNetwork) Broadcast(id int, block *Block) []Event {
@@ -135,7 +168,7 @@ type PeerSendEvent struct {
 }
 
 func (e *PeerSendEvent) Run(o *Oracle) ([]Event) {
-	log.Debugf("PeerSend  Event: time %.2f, block %d, sender %d", o.getRealTime(), e.block.index, e.senderID)
+	log.Debugf("PeerSend  Event: time %.2f, block %d, sender %d", o.RealTime(), e.block.index, e.senderID)
 	return e.network.sendBlockToBestPeer(e)
 }
 
@@ -147,14 +180,13 @@ func (pn *PeerNetwork) sendBlockToBestPeer(e *PeerSendEvent) []Event {
 	var result []Event
 	sender := e.senderID
 	block := e.block
-	currentTS := pn.oracle.getRealTime()
+	currentTS := pn.oracle.RealTime()
 
 	allHave := true
 	nextTime := -1.0
 
 	for _, p := range pn.peer[sender] {
-		peerMap := pn.sent[p]
-		if !peerMap.Has(block.index) {
+		if !pn.sent.Has(block.index, p) {
 			allHave = false
 			transTime := pn.blockSize * 8 / pn.bandwidth * 1.0
 			if pn.NET_TIME[sender] <= currentTS {
@@ -164,8 +196,8 @@ func (pn *PeerNetwork) sendBlockToBestPeer(e *PeerSendEvent) []Event {
 			} else {
 				pn.NET_TIME[sender] += transTime
 			}
-			peerMap.Add(block.index)
-			sendTime := pn.toTimestamp(pn.NET_TIME[sender]+pn.globalLatency) + int64(rand.Intn(1000))
+			pn.sent.Add(block.index, p)
+			sendTime := pn.toTimestamp(pn.NET_TIME[sender]+pn.globalLatency) + int64(pn.oracle.rand.Jitter.Intn(1000))
 			sendEvent := &SendBlockEvent{
 				BaseEvent: BaseEvent{
 					timestamp: sendTime,
@@ -215,7 +247,7 @@ func (pn *PeerNetwork) expressRelay(block *Block) []Event {
 			block:      block,
 		}
 		//log.Criticalf("express block %d", block.index)
-		pn.sent[attacker].Add(block.index)
+		pn.sent.Add(block.index, attacker)
 		result = append(result, sendEvent)
 	}
 	return result
@@ -226,7 +258,7 @@ func (pn *PeerNetwork) expressBroadcast(block *Block) []Event {
 		return []Event{}
 	}
 	result := make([]Event, 0)
-	for receiver := range pn.sent {
+	for receiver := 0; receiver < len(pn.peer); receiver++ {
 		if receiver == block.minerID {
 			continue
 		}
@@ -235,8 +267,49 @@ func (pn *PeerNetwork) expressBroadcast(block *Block) []Event {
 			receiverID: receiver,
 			block:      block,
 		}
-		pn.sent[receiver].Add(block.index)
+		pn.sent.Add(block.index, receiver)
 		result = append(result, sendEvent)
 	}
 	return result
 }
+
+type peerNetworkState struct {
+	Peers     [][]int
+	Sent      *nodeSetsState
+	NetTime   []float64
+	StartTime map[int]int64
+	EndTime   map[int]int64
+}
+
+func (pn *PeerNetwork) SaveState() (interface{}, error) {
+	n := len(pn.peer)
+	state := &peerNetworkState{
+		Peers:     make([][]int, n),
+		Sent:      pn.sent.saveState(),
+		NetTime:   pn.NET_TIME,
+		StartTime: pn.startTime,
+		EndTime:   pn.endTime,
+	}
+	for i := 0; i < n; i++ {
+		state.Peers[i] = pn.peer[i]
+	}
+	return state, nil
+}
+
+func (pn *PeerNetwork) LoadState(state interface{}) error {
+	s, ok := state.(*peerNetworkState)
+	if !ok {
+		return fmt.Errorf("can not restore a peer network from %T", state)
+	}
+	if len(s.Peers) != len(pn.peer) {
+		return fmt.Errorf("checkpoint has %d nodes, network has %d", len(s.Peers), len(pn.peer))
+	}
+	for i := range s.Peers {
+		pn.peer[i] = s.Peers[i]
+	}
+	pn.sent.loadState(s.Sent)
+	pn.NET_TIME = append([]float64(nil), s.NetTime...)
+	pn.startTime = copyTimes(s.StartTime)
+	pn.endTime = copyTimes(s.EndTime)
+	return nil
+}
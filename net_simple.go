@@ -1,4 +1,6 @@
-package main
+package simulator
+
+import "fmt"
 
 type SimpleNetwork struct {
 	oracle      *Oracle
@@ -8,15 +10,42 @@ type SimpleNetwork struct {
 	attacker    *Set
 }
 
-func NewSimpleNetwork(attacker bool) *SimpleNetwork {
+func init() {
+	RegisterNetwork(&NetworkFactory{
+		Name:  "simple",
+		Usage: "Fully connected network with constant delay",
+		Params: []Param{
+			{Name: "honestDelay", Kind: FloatParam, Default: "100", Usage: "Delay between honest miners (s)"},
+			{Name: "attackerIn", Kind: FloatParam, Default: "2", Usage: "Delay to the attacker (s)"},
+			{Name: "attackerOut", Kind: FloatParam, Default: "2", Usage: "Delay from the attacker (s)"},
+		},
+		New: func(cfg *Config, args Args) Network {
+			return NewSimpleNetwork(SimpleNetworkOptions{
+				HonestDelay: args.Float("honestDelay"),
+				AttackerIn:  args.Float("attackerIn"),
+				AttackerOut: args.Float("attackerOut"),
+				Attacker:    cfg.Attacker.Enabled,
+			})
+		},
+	})
+}
+
+type SimpleNetworkOptions struct {
+	HonestDelay float64 // Delay between honest miners (s)
+	AttackerIn  float64 // Delay to the attacker (s)
+	AttackerOut float64 // Delay from the attacker (s)
+	Attacker    bool    // Miner 0 is an attacker
+}
+
+func NewSimpleNetwork(options SimpleNetworkOptions) *SimpleNetwork {
 	isAttacker := NewSet()
-	if attacker {
+	if options.Attacker {
 		isAttacker.Add(0)
 	}
 	return &SimpleNetwork{
-		honestDelay: honestDelay,
-		attackerIn:  attackerIn,
-		attackerOut: attackerOut,
+		honestDelay: options.HonestDelay,
+		attackerIn:  options.AttackerIn,
+		attackerOut: options.AttackerOut,
 		attacker:    isAttacker,
 	}
 }
@@ -61,7 +90,7 @@ type BroadcastEvent struct {
 }
 
 func (e *BroadcastEvent) Run(o *Oracle) ([]Event) {
-	log.Debugf("Broadcast Event: time %.2f, block %d, miner %d", o.getRealTime(), e.block.index, e.block.minerID)
+	log.Debugf("Broadcast Event: time %.2f, block %d, miner %d", o.RealTime(), e.block.index, e.block.minerID)
 
 	events := make([]Event, 0)
 	for receiverID := range o.miners.miners {
@@ -77,3 +106,15 @@ func (e *BroadcastEvent) Run(o *Oracle) ([]Event) {
 	}
 	return events
 }
+
+// SimpleNetwork has no state besides the event queue.
+func (sn *SimpleNetwork) SaveState() (interface{}, error) {
+	return nil, nil
+}
+
+func (sn *SimpleNetwork) LoadState(state interface{}) error {
+	if state != nil {
+		return fmt.Errorf("can not restore a simple network from %T", state)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package simulator
+
+// Observer is notified by the oracle while a simulation runs. Metrics, invariant
+// checks and progress output are attached as observers instead of being written
+// into the events. Observers must not change the state of the simulation, so a
+// run gives the same result with or without them.
+type Observer interface {
+	// BeforeEvent is called before an event runs, the time of the oracle is the
+	// time of the event.
+	BeforeEvent(o *Oracle, event Event)
+	// AfterEvent is called after an event runs, with the events it generated.
+	AfterEvent(o *Oracle, event Event, results []Event)
+	// BlockMined is called when a miner has generated a block, its edges are set.
+	BlockMined(o *Oracle, block *Block)
+	// BlockDelivered is called when a block has reached a miner.
+	BlockDelivered(o *Oracle, block *Block, receiver int)
+	// PivotChanged is called when the pivot tip of the local graph of a miner
+	// changes, whether the chain is extended or switched to another branch. old
+	// is nil when the genesis block is inserted.
+	PivotChanged(o *Oracle, miner int, old *Block, new *Block)
+	// SimulationEnd is called once Run returns.
+	SimulationEnd(o *Oracle)
+}
+
+// BaseObserver implements every callback as a no-op. Observers embed it and
+// override the callbacks they need.
+type BaseObserver struct{}
+
+func (BaseObserver) BeforeEvent(*Oracle, Event)                {}
+func (BaseObserver) AfterEvent(*Oracle, Event, []Event)        {}
+func (BaseObserver) BlockMined(*Oracle, *Block)                {}
+func (BaseObserver) BlockDelivered(*Oracle, *Block, int)       {}
+func (BaseObserver) PivotChanged(*Oracle, int, *Block, *Block) {}
+func (BaseObserver) SimulationEnd(*Oracle)                     {}
+
+// AddObserver registers an observer. Observers are notified in the order they
+// are added.
+func (o *Oracle) AddObserver(observer Observer) {
+	o.observers = append(o.observers, observer)
+}
+
+// watchGraph reports the pivot changes of the fork choice of a miner to the
+// observers, if it is a local graph. Miners call it in Setup for the graph they
+// mine on.
+func (o *Oracle) watchGraph(g ForkChoice, miner int) {
+	if g, ok := g.(*LocalGraph); ok {
+		g.onPivot = func(old *Block, new *Block) {
+			o.notifyPivotChanged(miner, old, new)
+		}
+	}
+}
+
+func (o *Oracle) notifyPivotChanged(miner int, old *Block, new *Block) {
+	if p := o.windowPartition(miner); p != nil {
+		p.atCommit(func() {
+			o.notifyPivotChanged(miner, old, new)
+		})
+		return
+	}
+	for _, observer := range o.observers {
+		observer.PivotChanged(o, miner, old, new)
+	}
+}
+
+func (o *Oracle) notifyMined(block *Block) {
+	for _, observer := range o.observers {
+		observer.BlockMined(o, block)
+	}
+}
+
+func (o *Oracle) notifyDelivered(block *Block, receiver int) {
+	if p := o.windowPartition(receiver); p != nil {
+		p.atCommit(func() {
+			o.notifyDelivered(block, receiver)
+		})
+		return
+	}
+	for _, observer := range o.observers {
+		observer.BlockDelivered(o, block, receiver)
+	}
+}
+
+const reportInterval = 50 // Blocks between two reports of the scenarios
+
+// ReportObserver logs the pivot chain, the antiset and the epoch size of the
+// observer miner every `every` blocks.
+type ReportObserver struct {
+	BaseObserver
+	every int
+}
+
+func NewReportObserver(every int) *ReportObserver {
+	return &ReportObserver{every: every}
+}
+
+func (r *ReportObserver) BlockMined(o *Oracle, block *Block) {
+	if block.index%r.every != 0 {
+		return
+	}
+	viewGraph := o.observerGraph()
+	if viewGraph == nil {
+		return
+	}
+
+	log.Warning("")
+	log.Warningf("Current time: %.2f s", o.RealTime())
+
+	log.Noticef("Pivot block %d", viewGraph.PivotTip().index)
+	report_pivot(viewGraph)
+	report_anti(viewGraph, antisetDepth, o.options.SpecialMiner)
+	report_epochsize(viewGraph)
+	log.Warning("")
+}
@@ -1,9 +1,10 @@
-package main
+package simulator
 
 import (
-	"container/heap"
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
 	"math"
-	"math/rand"
 	"sort"
 )
 
@@ -11,8 +12,16 @@ type Block struct {
 	// Maintained by Oracle
 	index    int
 	minerID  int
-	seen     map[int]bool
+	seen     Bitset // Indexed by miner, nil once every miner has seen the block
+	seenNum  int
 	residual float64
+	hash     uint64     // Simulated hash, see TieHash
+	heavy    uint64     // Draw of the weight if the block is adaptive, see GhastConfig
+	adaptive adaptivity // See GhastConfig
+
+	time       int64   // Generation time
+	timestamp  int64   // Reported by the miner, see ClockConfig
+	difficulty float64 // See DifficultyAdjuster
 
 	// Maintained by Miner
 	height      int
@@ -25,7 +34,138 @@ type Block struct {
 	refChildren []*Block
 
 	// Maintained by Receiver
-	receivingTime map[int]int64
+	receivingTime []int64 // Indexed by node, -1 if not received, nil once every node has received the block
+	receivedNum   int
+	receivedSum   int64 // Sum of the receiving times
+	minerTime     int64 // Receiving time of the miner
+	lastTime      int64 // Latest receiving time
+}
+
+func (b *Block) Index() int {
+	return b.index
+}
+
+// MinerID returns the miner of the block, -1 for the genesis block.
+func (b *Block) MinerID() int {
+	return b.minerID
+}
+
+// Time returns the time slot the block was generated in.
+func (b *Block) Time() int64 {
+	return b.time
+}
+
+// Timestamp returns the time slot reported by the miner of the block. It is
+// the generation time unless the clocks of the nodes are skewed.
+func (b *Block) Timestamp() int64 {
+	return b.timestamp
+}
+
+// SetTimestamp lets a miner report another time in GenerateBlock.
+func (b *Block) SetTimestamp(timestamp int64) {
+	b.timestamp = timestamp
+}
+
+func (b *Block) Difficulty() float64 {
+	return b.difficulty
+}
+
+func (b *Block) Height() int {
+	return b.height
+}
+
+func (b *Block) Parent() *Block {
+	return b.parent
+}
+
+func (b *Block) References() []*Block {
+	return b.references
+}
+
+// SeenBy returns whether the miner id has generated or received the block.
+func (b *Block) SeenBy(id int) bool {
+	return b.seen == nil && b.seenNum > 0 || b.seen.Has(id)
+}
+
+// see marks the block as seen by the miner id, out of n miners.
+func (b *Block) see(id int, n int) {
+	if b.seen == nil {
+		if b.seenNum > 0 {
+			return
+		}
+		b.seen = NewBitset(n)
+	}
+	if b.seen.Add(id) {
+		b.seenNum++
+		if b.seenNum == n {
+			b.seen = nil
+		}
+	}
+}
+
+// receive records the first time the node has the block, out of n nodes, and
+// returns false if it had the block already. The time is then counted by
+// countReceived, which is separate as the counters are shared by the nodes (see
+// partition.atCommit).
+func (b *Block) receive(node int, timestamp int64, n int) bool {
+	if b.receivedNum == n {
+		return false
+	}
+	if b.receivingTime == nil {
+		b.receivingTime = make([]int64, n)
+		for i := range b.receivingTime {
+			b.receivingTime[i] = -1
+		}
+	}
+	if b.receivingTime[node] >= 0 {
+		return false
+	}
+	b.receivingTime[node] = timestamp
+	return true
+}
+
+// countReceived counts a time recorded by receive, and returns true once every
+// node has received the block. The times are freed then, only their sum and the
+// latest one are kept.
+func (b *Block) countReceived(node int, timestamp int64, n int) bool {
+	b.receivedNum++
+	b.receivedSum += timestamp
+	b.lastTime = max(b.lastTime, timestamp)
+	if node == b.minerID {
+		b.minerTime = timestamp
+	}
+	if b.receivedNum == n {
+		b.receivingTime = nil
+		return true
+	}
+	return false
+}
+
+// ReceivingTime returns the time the node has received the block. Once every
+// node has received it, the latest receiving time is returned for all of them.
+func (b *Block) ReceivingTime(node int) (int64, bool) {
+	if b.receivingTime == nil {
+		return b.lastTime, b.receivedNum > 0
+	}
+	if b.receivingTime[node] < 0 {
+		return 0, false
+	}
+	return b.receivingTime[node], true
+}
+
+// Link sets the parent edge and the reference edges of a newly generated block,
+// and registers it as a child of them. Miners call it in GenerateBlock.
+func (b *Block) Link(parent *Block, references []*Block, ancestorNum int) {
+	b.parent = parent
+	parent.children = append(parent.children, b)
+
+	b.height = parent.height + 1
+	b.ancestorNum = ancestorNum
+
+	b.references = references
+	for _, refBlock := range references {
+		refBlock.refChildren = append(refBlock.refChildren, b)
+	}
 }
 
 type MinerSet struct {
@@ -33,6 +173,7 @@ type MinerSet struct {
 	weights []float64
 
 	cumTable []float64
+	schedule []hashSegment // nil if the hash power is fixed
 }
 
 func (ms *MinerSet) normalize() {
@@ -49,41 +190,97 @@ func (ms *MinerSet) normalize() {
 	}
 }
 
+const DefaultTimePrecision = 1e6
+
+// OracleOptions configures an Oracle.
+type OracleOptions struct {
+	TimePrecision float64           // The number of time slots in one second
+	Rate          float64           // Generation rate (seconds/block)
+	Duration      float64           // The duration of the experiment (seconds)
+	Seed          int64             // Master seed of the random streams
+	Queue         string            // Scheduler of the event queue, HeapQueue or CalendarQueue
+	HashPower     []HashChange      // Changes of the hash power during the run
+	Clock         ClockConfig       // Clocks of the nodes and timestamp rules
+	TieBreak      string            // Fork choice between subtrees of the same weight, see TieBreaks
+	ForkChoice    ForkChoiceBuilder // Fork choice of the miners, nil for GHOST
+
+	Debug        bool // Check the consistency of local graphs after each insertion
+	Observer     int  // The miner whose local graph is reported
+	SpecialMiner bool // Miner 0 is an attacker or a special honest miner, it is reported separately
+}
+
+func DefaultOracleOptions() OracleOptions {
+	return OracleOptions{
+		TimePrecision: DefaultTimePrecision,
+		Rate:          5,
+		Duration:      5000 * 5,
+		Seed:          1,
+		Observer:      1,
+	}
+}
+
 type Oracle struct {
 	queue   *EventQueue
 	miners  *MinerSet
 	blocks  []*Block
 	network Network
+	rand    *RandStreams
+	options OracleOptions
 
 	timestamp     int64
 	timePrecision float64
 	rate          float64
 	duration      int64
+
+	traceHash  hash.Hash64  // Rolling hash of the executed events, nil if disabled
+	recorder   *TraceWriter // Records the block events, nil if disabled
+	replaying  bool         // Blocks come from a trace instead of mineNextBlock
+	replayStat replayStat
+	checkpoint *checkpointTrigger // nil if disabled
+
+	mined    int           // Number of GenBlockEvent executed
+	stop     StopCondition // nil to stop at duration
+	draining bool          // The stop condition is met, no more blocks are mined
+
+	observers []Observer
+
+	adjuster     DifficultyAdjuster // nil for the fixed difficulty
+	adjusterView ForkChoice
+
+	clocks []nodeClock // Indexed by miner, nil if every clock shows the time of the oracle
+
+	parallel *parallelRun // nil for the sequential engine
 }
 
-func NewOracle(timePrecision float64, rate float64, duration float64) *Oracle {
-	emptyQueue := make(EventPriorityQueue, 0)
-	queue := &EventQueue{queueList: &emptyQueue}
-	heap.Init(queue.queueList)
+func NewOracle(options OracleOptions) *Oracle {
+	queue, err := NewEventQueue(options.Queue)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	miners := &MinerSet{miners: []Miner{}, weights: []float64{}}
 
-	genesis := &Block{index: 0, minerID: -1, residual: 0, seen: make(map[int]bool), height: 0, ancestorNum: 0, receivingTime: make(map[int]int64)}
+	genesis := &Block{index: 0, minerID: -1, residual: 0, height: 0, ancestorNum: 0, difficulty: options.Rate}
 	blocks := []*Block{genesis}
 
-	return &Oracle{
+	o := &Oracle{
 		queue:         queue,
 		miners:        miners,
 		blocks:        blocks,
 		network:       nil,
+		rand:          NewRandStreams(options.Seed),
+		options:       options,
 		timestamp:     0,
-		timePrecision: timePrecision,
-		duration:      int64(timePrecision * duration),
-		rate:          rate,
+		timePrecision: options.TimePrecision,
+		duration:      int64(options.TimePrecision * options.Duration),
+		rate:          options.Rate,
 	}
+	genesis.hash = o.blockHash(0)
+	genesis.heavy = o.heavyDraw(0)
+	return o
 }
 
-func (o *Oracle) prepare() {
+func (o *Oracle) Prepare() {
 	newBlockEvent := o.mineNextBlock()
 	o.queue.Push(newBlockEvent)
 
@@ -94,37 +291,209 @@ func (o *Oracle) prepare() {
 	o.queue.Push(broadcastGenesisEvent)
 }
 
-func (o *Oracle) run() {
-	for {
-		event := o.queue.Pop()
-		o.timestamp = event.GetTimestamp()
+func (o *Oracle) Run() {
+	if o.parallel != nil {
+		o.parallel.run()
+	} else {
+		o.runSequential()
+	}
+	for _, observer := range o.observers {
+		observer.SimulationEnd(o)
+	}
+}
 
-		if o.timestamp > o.duration {
+func (o *Oracle) runSequential() {
+	for o.queue.Len() > 0 {
+		event := o.queue.Pop()
+		if o.ended(event) {
 			break
 		}
-
+		if o.skipped(event) {
+			continue
+		}
+		o.beforeEvent(event)
 		results := event.Run(o)
+		o.afterEvent(event, results)
 		for _, e := range results {
 			if e.GetTimestamp() >= o.timestamp {
 				o.queue.Push(e)
 			}
 		}
+		if o.checkpoint != nil {
+			o.checkCheckpoint()
+		}
+	}
+}
+
+// ended moves the time to the next event and reports whether the run ends before
+// it. Once the stop condition is met, the run is drained instead.
+func (o *Oracle) ended(event Event) bool {
+	o.timestamp = event.GetTimestamp()
+	if o.stop == nil {
+		return o.timestamp > o.duration
+	}
+	if !o.draining && o.stop.Stop(o) {
+		log.Warningf("Stop condition %s met at %.2f s after %d blocks, delivering the blocks in flight", o.stop, o.RealTime(), o.mined)
+		o.draining = true
+	}
+	return false
+}
+
+// skipped reports whether the event is dropped, i.e. a new block while the run is
+// drained.
+func (o *Oracle) skipped(event Event) bool {
+	_, ok := event.(*GenBlockEvent)
+	return ok && o.draining
+}
+
+func (o *Oracle) beforeEvent(event Event) {
+	if o.traceHash != nil {
+		o.hashEvent(event)
+	}
+	for _, observer := range o.observers {
+		observer.BeforeEvent(o, event)
+	}
+}
+
+func (o *Oracle) afterEvent(event Event, results []Event) {
+	if o.traceHash != nil {
+		o.hashEdges(event)
+	}
+	for _, observer := range o.observers {
+		observer.AfterEvent(o, event, results)
+	}
+	if o.recorder != nil {
+		o.recorder.recordEvent(event)
 	}
 }
 
-func (o *Oracle) getRealTime() float64 {
+// cancel calls off an event, in the queue it is pushed to.
+func (o *Oracle) cancel(event Event) bool {
+	if eq := event.base().eq; eq != nil {
+		return eq.Cancel(event)
+	}
+	return o.queue.Cancel(event)
+}
+
+// SetStopCondition replaces the duration by a stop condition. When it is met, the
+// remaining events except the generation of new blocks are executed, so the run
+// ends with every mined block delivered.
+func (o *Oracle) SetStopCondition(condition StopCondition) {
+	o.stop = condition
+}
+
+// MinedBlocks returns the number of blocks mined so far, genesis excluded.
+func (o *Oracle) MinedBlocks() int {
+	return o.mined
+}
+
+// EnableTraceHash makes the oracle fold the executed block events into a rolling
+// hash. Two runs of a deterministic scenario end with the same hash, and so does
+// the replay of the trace of a run. A hash restored from a checkpoint is kept.
+func (o *Oracle) EnableTraceHash() {
+	if o.traceHash == nil {
+		o.traceHash = fnv.New64a()
+	}
+}
+
+// hashEvent folds a block generation or delivery into the hash, in the order of
+// execution. The other events, e.g. the packets of the network, only matter
+// through the deliveries they schedule, and a replay does not run them. The
+// sequence numbers are left out for the same reason.
+func (o *Oracle) hashEvent(event Event) {
+	var buf [8]byte
+	write := func(v int64) {
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		o.traceHash.Write(buf[:])
+	}
+	switch e := event.(type) {
+	case *GenBlockEvent:
+		write(int64(TraceGenBlock))
+		write(e.timestamp)
+		write(int64(e.block.index))
+		write(int64(e.block.minerID))
+	case *SendBlockEvent:
+		write(int64(TraceSendBlock))
+		write(e.timestamp)
+		write(int64(e.block.index))
+		write(int64(e.receiverID))
+	}
+}
+
+// hashEdges folds the parent and the references chosen by the miner of a new
+// block into the hash, so the hash covers the fork choice and the tie-breaks.
+func (o *Oracle) hashEdges(event Event) {
+	e, ok := event.(*GenBlockEvent)
+	if !ok {
+		return
+	}
+	edges := []int64{-1, int64(len(e.block.references))}
+	if e.block.parent != nil {
+		edges[0] = int64(e.block.parent.index)
+	}
+	refs := make([]int64, 0, len(e.block.references))
+	for _, ref := range e.block.references {
+		refs = append(refs, int64(ref.index))
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i] < refs[j]
+	})
+	var buf [8]byte
+	for _, v := range append(edges, refs...) {
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		o.traceHash.Write(buf[:])
+	}
+}
+
+func (o *Oracle) TraceHash() uint64 {
+	if o.traceHash == nil {
+		return 0
+	}
+	return o.traceHash.Sum64()
+}
+
+// Timestamp returns the current time in time slots.
+func (o *Oracle) Timestamp() int64 {
+	return o.timestamp
+}
+
+func (o *Oracle) TimePrecision() float64 {
+	return o.timePrecision
+}
+
+func (o *Oracle) Network() Network {
+	return o.network
+}
+
+// Blocks returns all the mined blocks, including the blocks hidden by attackers.
+func (o *Oracle) Blocks() []*Block {
+	return o.blocks
+}
+
+func (o *Oracle) RealTime() float64 {
 	return float64(o.timestamp) / o.timePrecision
 }
 
-func (o *Oracle) lenMiner() int {
+// QueueLen returns the number of scheduled events.
+func (o *Oracle) QueueLen() int {
+	n := o.queue.Len()
+	if o.parallel != nil {
+		for _, part := range o.parallel.parts {
+			n += part.queue.Len()
+		}
+	}
+	return n
+}
+
+func (o *Oracle) LenMiner() int {
 	return len(o.miners.miners)
 }
 
-func (o *Oracle) getMiner(id int) Miner {
+func (o *Oracle) GetMiner(id int) Miner {
 	return o.miners.miners[id]
 }
 
-func (o *Oracle) addMiner(miner Miner, weight float64) int {
+func (o *Oracle) AddMiner(miner Miner, weight float64) int {
 	ms := o.miners
 	index := len(ms.miners)
 	miner.Setup(o, index)
@@ -134,29 +503,53 @@ func (o *Oracle) addMiner(miner Miner, weight float64) int {
 	return index
 }
 
-func (o *Oracle) addHonestMiner(weight float64) int {
+func (o *Oracle) AddHonestMiner(weight float64) int {
 	miner := NewHonestMiner()
-	return o.addMiner(miner, weight)
+	return o.AddMiner(miner, weight)
 }
 
-func (o *Oracle) finalizeMiners() {
+func (o *Oracle) FinalizeMiners() {
 	o.miners.normalize()
+	o.setupClocks()
+	if len(o.options.HashPower) > 0 {
+		schedule, err := buildSchedule(o.miners.weights, o.options.HashPower, o.timePrecision)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.miners.schedule = schedule
+	}
 }
 
-func (o *Oracle) setNetwork(network Network) {
+func (o *Oracle) SetNetwork(network Network) {
 	network.Setup(o)
 	o.network = network
 }
 
+func (o *Oracle) newBlock(minerID int, residual float64) *Block {
+	block := &Block{
+		index:    len(o.blocks),
+		minerID:  minerID,
+		residual: residual,
+		hash:     o.blockHash(len(o.blocks)),
+		heavy:    o.heavyDraw(len(o.blocks)),
+	}
+	o.blocks = append(o.blocks, block)
+	return block
+}
+
 func (o *Oracle) mineNextBlock() Event {
+	if o.miners.schedule != nil {
+		return o.mineScheduled()
+	}
 	nextStamp := o.timestamp
 
-	difficulty := o.timePrecision * o.rate
+	rate := o.difficulty()
+	difficulty := o.timePrecision * rate
 	threshold := 3 * int64(math.Ceil(difficulty))
 	var residual float64
 
 	for {
-		r := rand.Float64()
+		r := o.rand.Arrival.Float64()
 		fk := math.Log(r) / (math.Log(1 - 1/difficulty))
 		k := int64(math.Ceil(fk))
 		residual = float64(k) - fk
@@ -168,19 +561,9 @@ func (o *Oracle) mineNextBlock() Event {
 		}
 	}
 
-	pickedID := sort.SearchFloat64s(o.miners.cumTable, rand.Float64())
-
-	block := &Block{
-		index:         len(o.blocks),
-		minerID:       pickedID,
-		residual:      residual,
-		seen:          make(map[int]bool),
-		receivingTime: make(map[int]int64),
-	}
-	for id := range o.miners.miners {
-		block.seen[id] = false
-	}
-	o.blocks = append(o.blocks, block)
+	pickedID := sort.SearchFloat64s(o.miners.cumTable, o.rand.Miner.Float64())
+	block := o.newBlock(pickedID, residual)
+	block.difficulty = rate
 
 	newBlockEvent := &GenBlockEvent{
 		BaseEvent: BaseEvent{timestamp: nextStamp},
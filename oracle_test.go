@@ -0,0 +1,27 @@
+package simulator
+
+import "testing"
+
+func TestTraceHashCoversForkChoice(t *testing.T) {
+	hashes := make(map[uint64]string)
+	for _, variant := range []struct {
+		forkChoice string
+		tieBreak   string
+	}{
+		{"ghost", ""},
+		{"ghast:beta=5,heavy=10", ""},
+		{"ghost", TieRandom},
+	} {
+		cfg := testConfig(5)
+		cfg.ForkChoice, cfg.TieBreak = variant.forkChoice, variant.tieBreak
+		first := runScenario(t, cfg).TraceHash()
+		if second := runScenario(t, cfg).TraceHash(); first != second {
+			t.Fatalf("%v: trace hash %x then %x", variant, first, second)
+		}
+		name := variant.forkChoice + " " + variant.tieBreak
+		if other, ok := hashes[first]; ok {
+			t.Errorf("%s and %s give the same trace hash %x", name, other, first)
+		}
+		hashes[first] = name
+	}
+}
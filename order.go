@@ -0,0 +1,207 @@
+package simulator
+
+import "container/heap"
+
+// The total order of Conflux: the epochs of the pivot chain in sequence, the
+// epoch of a pivot block being the blocks in its past which are not in the epoch
+// of an earlier pivot block. The blocks of an epoch are sorted topologically, the
+// ties broken by the lower hash (see TieHash), then by the lower index, so the
+// pivot block comes last.
+//
+// The epoch of a pivot block only depends on the pivot chain up to it, as the
+// past of a block is complete when it is inserted. So the order is kept across
+// insertions and only the epochs above the lowest pivot height which changed
+// are computed again, when the order is queried.
+
+// totalOrder is the state of the total order of a local graph.
+type totalOrder struct {
+	blocks []*Block
+	digest []uint64         // digest[i] is the digest of blocks[:i+1]
+	start  []int            // Index in blocks of the first block of each epoch, indexed by pivot height
+	pivots []*DetailedBlock // Pivot block of each epoch
+	stale  int              // The epochs from this pivot height on must be computed again
+	kept   int              // Length of the prefix kept since the last call to TotalOrder
+}
+
+// pivotChanged records that the pivot chain changed from the given height on.
+func (t *totalOrder) pivotChanged(height int) {
+	t.stale = min(t.stale, height)
+}
+
+// Order returns the blocks of the graph in the total order. The slice belongs to
+// the graph and is valid until the next insertion.
+func (g *LocalGraph) Order() []*Block {
+	g.updateOrder()
+	return g.order.blocks
+}
+
+// TotalOrder returns the blocks of the graph in the total order, and the length
+// of its prefix which is unchanged since the previous call. The slice belongs to
+// the graph and is valid until the next insertion.
+func (g *LocalGraph) TotalOrder() ([]*Block, int) {
+	g.updateOrder()
+	kept := g.order.kept
+	g.order.kept = len(g.order.blocks)
+	return g.order.blocks, kept
+}
+
+// OrderDigest returns a digest of the first n blocks of the total order, so the
+// orders of two graphs can be compared without walking them.
+func (g *LocalGraph) OrderDigest(n int) uint64 {
+	g.updateOrder()
+	if n == 0 {
+		return 0
+	}
+	return g.order.digest[n-1]
+}
+
+// CommonOrderPrefix returns the length of the longest common prefix of the total
+// orders of two graphs, e.g. the local graphs of two miners.
+func CommonOrderPrefix(a *LocalGraph, b *LocalGraph) int {
+	a.updateOrder()
+	b.updateOrder()
+	da, db := a.order.digest, b.order.digest
+	// The digests of the prefixes agree up to the common prefix and differ after.
+	low, high := 0, min(len(da), len(db))
+	for low < high {
+		mid := (low + high + 1) / 2
+		if da[mid-1] == db[mid-1] {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low
+}
+
+// updateOrder computes the epochs from the stale height to the pivot tip.
+func (g *LocalGraph) updateOrder() {
+	t := &g.order
+	if g.pivotTip == nil {
+		return
+	}
+	if t.stale < len(t.start) {
+		end := t.start[t.stale]
+		for _, block := range t.blocks[end:] {
+			g.ledger[block.index].epoch = -1
+		}
+		clear(t.blocks[end:])
+		clear(t.pivots[t.stale:])
+		t.blocks, t.digest = t.blocks[:end], t.digest[:end]
+		t.start, t.pivots = t.start[:t.stale], t.pivots[:t.stale]
+		t.kept = min(t.kept, end)
+	}
+
+	var pivots []*DetailedBlock
+	for db := g.pivotTip; db.block.height >= len(t.start); db = db.parent {
+		pivots = append(pivots, db)
+		if db.isGenesis() {
+			break
+		}
+	}
+	for i := len(pivots) - 1; i >= 0; i-- {
+		t.start = append(t.start, len(t.blocks))
+		t.pivots = append(t.pivots, pivots[i])
+		for _, block := range g.sortEpoch(pivots[i]) {
+			var last uint64
+			if len(t.digest) > 0 {
+				last = t.digest[len(t.digest)-1]
+			}
+			t.blocks = append(t.blocks, block)
+			t.digest = append(t.digest, mix64(last, block.hash))
+		}
+	}
+	t.stale = len(t.start)
+}
+
+// sortEpoch marks the epoch of a pivot block and returns its blocks in the total
+// order. The earlier epochs must be marked.
+func (g *LocalGraph) sortEpoch(pivot *DetailedBlock) []*Block {
+	epoch := pivot.block.height
+	pivot.epoch = epoch
+	members := []*DetailedBlock{pivot}
+	for i := 0; i < len(members); i++ {
+		for _, parent := range g.parents(members[i]) {
+			if parent.epoch < 0 {
+				parent.epoch = epoch
+				members = append(members, parent)
+			}
+		}
+	}
+
+	// Kahn's algorithm, the ready block with the lowest hash first.
+	pending := make(map[*DetailedBlock]int, len(members))
+	ready := &hashHeap{}
+	for _, db := range members {
+		for _, parent := range g.parents(db) {
+			if parent.epoch == epoch {
+				pending[db]++
+			}
+		}
+		if pending[db] == 0 {
+			heap.Push(ready, db)
+		}
+	}
+	sorted := make([]*Block, 0, len(members))
+	for ready.Len() > 0 {
+		db := heap.Pop(ready).(*DetailedBlock)
+		sorted = append(sorted, db.block)
+		for _, child := range g.epochChildren(db, epoch) {
+			pending[child]--
+			if pending[child] == 0 {
+				heap.Push(ready, child)
+			}
+		}
+	}
+	return sorted
+}
+
+// parents returns the parent and the referenced blocks of a block.
+func (g *LocalGraph) parents(db *DetailedBlock) []*DetailedBlock {
+	parents := make([]*DetailedBlock, 0, len(db.block.references)+1)
+	if !db.isGenesis() {
+		parents = append(parents, db.parent)
+	}
+	for _, ref := range db.block.references {
+		parents = append(parents, g.ledger[ref.index])
+	}
+	return parents
+}
+
+// epochChildren returns the blocks of an epoch which have db as parent or
+// reference.
+func (g *LocalGraph) epochChildren(db *DetailedBlock, epoch int) []*DetailedBlock {
+	var children []*DetailedBlock
+	for _, child := range g.getAllChildren(db) {
+		if child.epoch == epoch {
+			children = append(children, child)
+		}
+	}
+	for _, child := range g.getAllRefChildren(db) {
+		if child.epoch == epoch {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+type hashHeap []*DetailedBlock
+
+func (h hashHeap) Len() int { return len(h) }
+
+func (h hashHeap) Less(i, j int) bool {
+	a, b := h[i].block, h[j].block
+	if a.hash != b.hash {
+		return a.hash < b.hash
+	}
+	return a.index < b.index
+}
+
+func (h hashHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x interface{}) { *h = append(*h, x.(*DetailedBlock)) }
+func (h *hashHeap) Pop() interface{} {
+	old := *h
+	db := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return db
+}
@@ -0,0 +1,156 @@
+package simulator
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// randomDAG mines n blocks on the views of a few miners, which receive the blocks
+// of the others late, so their pivot chains compete. Each block links the pivot
+// tip and the tips of the view of its miner, as FillNewBlock does. deliver is
+// called with the blocks in the mining order. If hashes is positive, the hashes
+// are drawn below it, so many blocks share a hash.
+func randomDAG(rng *rand.Rand, n int, hashes uint64, deliver func(block *Block)) {
+	newBlock := func(index int, miner int) *Block {
+		block := &Block{index: index, minerID: miner, residual: rng.Float64(), hash: rng.Uint64()}
+		if hashes > 0 {
+			block.hash %= hashes
+		}
+		return block
+	}
+	genesis := newBlock(0, -1)
+	views := make([]*LocalGraph, 4)
+	inbox := make([][]*Block, len(views))
+	for i := range views {
+		views[i] = NewLocalGraph()
+		views[i].Insert(genesis)
+	}
+	deliver(genesis)
+
+	for index := 1; index <= n; index++ {
+		miner := rng.Intn(len(views))
+		block := newBlock(index, miner)
+		views[miner].FillNewBlock(block)
+		views[miner].Insert(block)
+		deliver(block)
+		for i := range views {
+			if i != miner {
+				inbox[i] = append(inbox[i], block)
+			}
+		}
+		for i, view := range views {
+			late := inbox[i][:0]
+			for _, block := range inbox[i] {
+				if rng.Intn(3) > 0 || view.Insert(block) == Fail {
+					late = append(late, block)
+				}
+			}
+			inbox[i] = late
+		}
+	}
+}
+
+// pivotSwitched reports whether the new pivot tip is not a descendant of the old
+// one.
+func pivotSwitched(old *Block, new *Block) bool {
+	if old == nil {
+		return false
+	}
+	for new != nil && new.height > old.height {
+		new = new.parent
+	}
+	return new != old
+}
+
+// orderFromScratch computes the total order from the epochs of epochsFromScratch:
+// in each epoch, the block with the lowest hash, then the lowest index, among the
+// blocks whose parent and references in the epoch are placed.
+func orderFromScratch(g *LocalGraph, epochs map[int]int) []*Block {
+	members := make(map[int][]*Block)
+	for index, epoch := range epochs {
+		members[epoch] = append(members[epoch], g.ledger[index].block)
+	}
+	var order []*Block
+	for db := g.genesis; db != nil; db = db.maxChild {
+		left := members[db.block.height]
+		for len(left) > 0 {
+			best := -1
+			for i, block := range left {
+				if !placedAncestors(block, left) {
+					continue
+				}
+				if best < 0 || block.hash < left[best].hash || block.hash == left[best].hash && block.index < left[best].index {
+					best = i
+				}
+			}
+			order = append(order, left[best])
+			left = append(left[:best:best], left[best+1:]...)
+		}
+	}
+	return order
+}
+
+// placedAncestors reports whether no parent or reference of a block is left.
+func placedAncestors(block *Block, left []*Block) bool {
+	for _, other := range left {
+		if other == block.parent {
+			return false
+		}
+		for _, ref := range block.references {
+			if other == ref {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TestTotalOrderFromScratch checks the total order and the epochs kept across
+// insertions against the ones computed from scratch, after every insertion, and
+// that the prefix reported as kept is unchanged. Half of the runs draw the hashes
+// from three values, so the epochs are sorted on ties.
+func TestTotalOrderFromScratch(t *testing.T) {
+	switches := 0
+	for seed := int64(1); seed <= 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		var hashes uint64
+		if seed%2 == 0 {
+			hashes = 3
+		}
+		g := NewLocalGraph()
+		g.onPivot = func(old, new *Block) {
+			if pivotSwitched(old, new) {
+				switches++
+			}
+		}
+		var previous []*Block
+		randomDAG(rng, 300, hashes, func(block *Block) {
+			if result := g.Insert(block); result != Success {
+				t.Fatalf("seed %d: insert block %d: %v", seed, block.index, result)
+			}
+			order, kept := g.TotalOrder()
+			epochs, _ := g.epochsFromScratch()
+			want := orderFromScratch(g, epochs)
+			if len(order) != len(want) {
+				t.Fatalf("seed %d, block %d: %d blocks in the total order, want %d", seed, block.index, len(order), len(want))
+			}
+			for i := range want {
+				if order[i] != want[i] {
+					t.Fatalf("seed %d, block %d: the total order has block %d at %d, want %d", seed, block.index, order[i].index, i, want[i].index)
+				}
+				if epoch := g.Epoch(want[i]); epoch != epochs[want[i].index] {
+					t.Fatalf("seed %d, block %d: block %d is in epoch %d, want %d", seed, block.index, want[i].index, epoch, epochs[want[i].index])
+				}
+			}
+			for i := 0; i < kept; i++ {
+				if order[i] != previous[i] {
+					t.Fatalf("seed %d, block %d: the kept prefix of %d blocks changed at %d", seed, block.index, kept, i)
+				}
+			}
+			previous = append(previous[:0], order...)
+		})
+	}
+	if switches == 0 {
+		t.Fatal("the pivot chain never switched to another branch")
+	}
+}
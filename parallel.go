@@ -0,0 +1,426 @@
+package simulator
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The parallel engine runs the events of the bitcoin network on several
+// goroutines and gives exactly the same run as the sequential engine.
+//
+// The nodes are cut into partitions of consecutive IDs, each with an event queue
+// of its own. An event which only touches the state of a node (a nodeEvent) goes
+// to the queue of the partition of the node; the other events, e.g. the
+// generation of blocks, and the events of the observer go to the queue of the
+// oracle and run alone, as they read the state of every node.
+//
+// A node only reaches another one by a packet, which takes at least the
+// lookahead of the network (see BitcoinNetwork.lookahead). So the events before
+// the earliest one plus the lookahead can not be affected by the other
+// partitions, and the partitions run them concurrently: a window. The window also
+// stops before the next event of the oracle queue.
+//
+// The window is then committed in the order of the sequential engine: the events
+// of the partitions are merged by timestamp and sequence number, and for each one
+// the oracle runs what the sequential engine would have done at that point. The
+// stop condition and the observers are called, the events which go to another
+// queue get their sequence numbers and are pushed, and the effects on the state
+// shared by the nodes are applied (see partition.atCommit). The effects include
+// the delays drawn from the jitter stream (see Oracle.delay), so the random
+// streams are read in the same order too.
+
+// nodeEvent is an event which only touches the state of a node.
+type nodeEvent interface {
+	node() int
+}
+
+func (e *SendBlockEvent) node() int {
+	return e.receiverID
+}
+
+func (e *WakeupTrafficEvent) node() int {
+	return e.sender.id
+}
+
+// A packet is queued when it is constructed by its sender, and when it arrives
+// at its receiver.
+func (e *PacketEvent) node() int {
+	if e.status == sending {
+		return e.receiverID
+	}
+	return e.senderID
+}
+
+type eventFate int
+
+const (
+	dropped eventFate = iota // Not pushed, as in the sequential engine
+	queued                   // Pushed to the queue of the partition
+	held                     // Pushed to its queue at the commit
+)
+
+// executedEvent is an event run in a window, with what is left to do at its
+// commit.
+type executedEvent struct {
+	event   Event
+	results []Event
+	fates   []eventFate // Indexed as results
+	effects []func()
+	delayed []Event // Results whose timestamps are set by effects
+}
+
+type partition struct {
+	run     *parallelRun
+	queue   *EventQueue
+	now     int64          // Timestamp of the running event
+	current *executedEvent // nil between the events
+	done    []executedEvent
+	next    int // First event of done not committed
+	start   chan struct{}
+}
+
+type parallelRun struct {
+	o         *Oracle
+	parts     []*partition
+	chunk     int // Nodes per partition, a multiple of 64 so the partitions do not share words of bitsets
+	serial    int // The observer, its events run alone
+	lookahead int64
+
+	window bool  // The partitions are running a window
+	end    int64 // The window runs the events before end and before limit
+	limit  Event // The next event of the oracle queue, nil if there is none
+	wg     sync.WaitGroup
+	routed []Event // Held events to push at the end of the commit
+}
+
+// SetParallel runs the events of the nodes on the given number of goroutines.
+// It is only supported by the bitcoin network without the express links of an
+// attacker and without request timeouts, and with honest and timewarp miners.
+// The run can not be checkpointed, recorded or replayed. SetParallel is called
+// once the network is set and the oracle is prepared.
+func (o *Oracle) SetParallel(workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("parallel: need at least one worker")
+	}
+	bn, ok := o.network.(*BitcoinNetwork)
+	if !ok {
+		return fmt.Errorf("parallel: only the bitcoin network is supported, not %T", o.network)
+	}
+	if bn.attacker.Len() > 0 {
+		return fmt.Errorf("parallel: the express links of the attacker are not supported")
+	}
+	if bn.requestTimeout > 0 {
+		return fmt.Errorf("parallel: request timeouts are not supported")
+	}
+	for id, miner := range o.miners.miners {
+		switch miner.(type) {
+		case *HonestMiner, *TimewarpMiner:
+		default:
+			return fmt.Errorf("parallel: miner %d (%T) is not supported", id, miner)
+		}
+	}
+	lookahead := bn.lookahead()
+	if lookahead < 1 {
+		return fmt.Errorf("parallel: the network has no lookahead, the verification time must be positive")
+	}
+
+	n := o.LenMiner()
+	chunk := ((n+workers-1)/workers + 63) / 64 * 64
+	r := &parallelRun{o: o, chunk: chunk, serial: o.options.Observer, lookahead: lookahead}
+	for first := 0; first < n; first += chunk {
+		queue, err := NewEventQueue(o.options.Queue)
+		if err != nil {
+			return err
+		}
+		r.parts = append(r.parts, &partition{run: r, queue: queue, start: make(chan struct{})})
+	}
+	// The uplinks are created before the run, as the partitions share the map.
+	for id := 0; id < n; id++ {
+		bn.traffic.node(id, o.timestamp)
+	}
+	o.parallel = r
+
+	var moved []Event
+	o.queue.sched.each(func(e Event) {
+		if r.queueOf(e) != o.queue {
+			moved = append(moved, e)
+		}
+	})
+	for _, e := range moved {
+		o.queue.sched.remove(e.base())
+		r.queueOf(e).restore(e)
+	}
+	return nil
+}
+
+// windowPartition returns the partition running the events of a node, nil if no
+// window is running. In a window, the updates of the state shared by the nodes
+// are deferred to the commit, see partition.atCommit.
+func (o *Oracle) windowPartition(node int) *partition {
+	r := o.parallel
+	if r == nil || !r.window || node == r.serial {
+		return nil
+	}
+	return r.parts[node/r.chunk]
+}
+
+// now returns the current time of a node. It is the time of the oracle, except
+// in a window where each partition has its own time.
+func (o *Oracle) now(node int) int64 {
+	if p := o.windowPartition(node); p != nil {
+		return p.now
+	}
+	return o.timestamp
+}
+
+func (o *Oracle) realTimeAt(node int) float64 {
+	return float64(o.now(node)) / o.timePrecision
+}
+
+// atCommit defers f, an update of the state shared by the nodes, to the commit
+// of the running event. The callers check windowPartition first, so the
+// sequential engine does not allocate f.
+func (p *partition) atCommit(f func()) {
+	p.current.effects = append(p.current.effects, f)
+}
+
+// delay sets the timestamp of e, a result of an event of the node, to from plus
+// pings times the delay of the link, which draws from the jitter stream. In a
+// window the delay is drawn at the commit of the event, and e must not run before
+// the end of the window.
+func (o *Oracle) delay(node int, e Event, from int64, pings int64, link *PacketEvent) {
+	if p := o.windowPartition(node); p != nil {
+		p.current.delayed = append(p.current.delayed, e)
+		p.atCommit(func() {
+			e.base().timestamp = from + pings*link.pingDelay()
+		})
+		return
+	}
+	e.base().timestamp = from + pings*link.pingDelay()
+}
+
+// pushAt pushes an event with a sequence number given by the parallel engine.
+func (eq *EventQueue) pushAt(x Event, seq uint64) {
+	x.base().fired = false
+	x.SetSeq(seq)
+	eq.restore(x)
+}
+
+func (r *parallelRun) queueOf(e Event) *EventQueue {
+	if ne, ok := e.(nodeEvent); ok && ne.node() != r.serial {
+		return r.parts[ne.node()/r.chunk].queue
+	}
+	return r.o.queue
+}
+
+func (r *parallelRun) inWindow(e Event) bool {
+	return e.GetTimestamp() < r.end && (r.limit == nil || eventBefore(e, r.limit))
+}
+
+// schedule pushes an event to its queue with the next sequence number.
+func (r *parallelRun) schedule(e Event) {
+	if e.base().cancelled {
+		return
+	}
+	r.queueOf(e).pushAt(e, r.o.queue.nextSeq)
+	r.o.queue.nextSeq++
+}
+
+func (r *parallelRun) run() {
+	o := r.o
+	if o.checkpoint != nil || o.recorder != nil || o.replaying {
+		log.Fatal("parallel: checkpoints and traces are not supported")
+	}
+	for _, p := range r.parts {
+		go func(p *partition) {
+			for range p.start {
+				p.runWindow()
+				r.wg.Done()
+			}
+		}(p)
+	}
+	defer func() {
+		for _, p := range r.parts {
+			close(p.start)
+		}
+	}()
+
+	for {
+		serial := o.queue.peek()
+		var head Event
+		for _, p := range r.parts {
+			if e := p.queue.peek(); e != nil && (head == nil || eventBefore(e, head)) {
+				head = e
+			}
+		}
+		if head == nil && serial == nil {
+			return
+		}
+		if head == nil || serial != nil && eventBefore(serial, head) {
+			if !r.runSerial() {
+				return
+			}
+			continue
+		}
+		// The stop condition is checked for the first event of the window
+		// before it runs, as it may read any node.
+		if o.ended(head) {
+			return
+		}
+		r.runWindow(head, serial)
+	}
+}
+
+// runSerial runs the next event of the oracle queue as the sequential engine
+// does, it returns false if the run ends.
+func (r *parallelRun) runSerial() bool {
+	o := r.o
+	event := o.queue.Pop()
+	if o.ended(event) {
+		return false
+	}
+	if o.skipped(event) {
+		return true
+	}
+	o.beforeEvent(event)
+	results := event.Run(o)
+	o.afterEvent(event, results)
+	for _, e := range results {
+		if e.GetTimestamp() >= o.timestamp {
+			r.schedule(e)
+		}
+	}
+	return true
+}
+
+func (r *parallelRun) runWindow(head Event, serial Event) {
+	o := r.o
+	r.end = head.GetTimestamp() + r.lookahead
+	if o.stop == nil {
+		r.end = min(r.end, o.duration+1)
+	}
+	r.limit = serial
+
+	var active []*partition
+	for _, p := range r.parts {
+		if e := p.queue.peek(); e != nil && r.inWindow(e) {
+			// The events pushed in the window get provisional sequence
+			// numbers, in the same order as the final ones.
+			p.queue.nextSeq = o.queue.nextSeq
+			active = append(active, p)
+		}
+	}
+	r.window = true
+	if len(active) == 1 {
+		active[0].runWindow()
+	} else {
+		r.wg.Add(len(active))
+		for _, p := range active {
+			p.start <- struct{}{}
+		}
+		r.wg.Wait()
+	}
+	r.window = false
+	r.commit(active)
+}
+
+func (p *partition) runWindow() {
+	r := p.run
+	for {
+		event := p.queue.peek()
+		if event == nil || !r.inWindow(event) {
+			break
+		}
+		p.queue.Pop()
+		p.now = event.GetTimestamp()
+		p.done = append(p.done, executedEvent{event: event})
+		p.current = &p.done[len(p.done)-1]
+
+		results := event.Run(r.o)
+		fates := make([]eventFate, len(results))
+		for i, e := range results {
+			switch {
+			case p.current.isDelayed(e):
+				fates[i] = held
+			case e.GetTimestamp() < p.now || e.base().cancelled:
+				fates[i] = dropped
+			case r.queueOf(e) == p.queue:
+				p.queue.Push(e)
+				fates[i] = queued
+			default:
+				fates[i] = held
+			}
+		}
+		p.current.results, p.current.fates = results, fates
+	}
+	p.current = nil
+}
+
+func (e *executedEvent) isDelayed(x Event) bool {
+	for _, d := range e.delayed {
+		if d == x {
+			return true
+		}
+	}
+	return false
+}
+
+// commit replays the events of the window in the order of the sequential engine.
+// The events of a partition are in that order already.
+func (r *parallelRun) commit(parts []*partition) {
+	o := r.o
+	first := true
+	for {
+		var next *partition
+		for _, p := range parts {
+			if p.next < len(p.done) && (next == nil || eventBefore(p.done[p.next].event, next.done[next.next].event)) {
+				next = p
+			}
+		}
+		if next == nil {
+			break
+		}
+		executed := &next.done[next.next]
+		next.next++
+
+		event := executed.event
+		if !first {
+			// The window ends before the duration, so only the stop
+			// condition is checked.
+			o.ended(event)
+		}
+		first = false
+		o.beforeEvent(event)
+		for _, effect := range executed.effects {
+			effect()
+		}
+		o.afterEvent(event, executed.results)
+		for i, e := range executed.results {
+			switch executed.fates[i] {
+			case queued:
+				e.SetSeq(o.queue.nextSeq)
+				o.queue.nextSeq++
+			case held:
+				if e.GetTimestamp() < o.timestamp || e.base().cancelled {
+					continue
+				}
+				e.SetSeq(o.queue.nextSeq)
+				o.queue.nextSeq++
+				if r.inWindow(e) {
+					log.Panicf("parallel: %T at %d is in the window ending at %d, the lookahead %d is too long", e, e.GetTimestamp(), r.end, r.lookahead)
+				}
+				r.routed = append(r.routed, e)
+			}
+		}
+	}
+	for _, p := range parts {
+		clear(p.done)
+		p.done, p.next = p.done[:0], 0
+	}
+	// The queues are ordered on the final sequence numbers now.
+	for _, e := range r.routed {
+		r.queueOf(e).pushAt(e, e.GetSeq())
+	}
+	clear(r.routed)
+	r.routed = r.routed[:0]
+}
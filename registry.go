@@ -0,0 +1,294 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Components (networks and miners) register a factory under a name, so they can be
+// selected by a spec string like "withhold:delayRef" or "bitcoin:verifyTime=0.2".
+// A spec is the component name optionally followed by ':' and a comma separated
+// list of arguments. An argument is either "key=value" or a positional value,
+// which is assigned to the parameters in declaration order.
+
+type ParamKind int
+
+const (
+	IntParam ParamKind = iota + 1
+	FloatParam
+	StringParam
+	BoolParam
+)
+
+func (k ParamKind) String() string {
+	switch k {
+	case IntParam:
+		return "int"
+	case FloatParam:
+		return "float"
+	case StringParam:
+		return "string"
+	case BoolParam:
+		return "bool"
+	}
+	return "unknown"
+}
+
+type Param struct {
+	Name    string
+	Kind    ParamKind
+	Default string
+	Choices []string // Allowed values, any value if empty
+	Usage   string
+}
+
+func (p *Param) check(value string) error {
+	var err error
+	switch p.Kind {
+	case IntParam:
+		_, err = strconv.Atoi(value)
+	case FloatParam:
+		_, err = strconv.ParseFloat(value, 64)
+	case BoolParam:
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return fmt.Errorf("parameter %s expects %s, got %q", p.Name, p.Kind, value)
+	}
+	if len(p.Choices) > 0 {
+		for _, choice := range p.Choices {
+			if choice == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("parameter %s expects one of %v, got %q", p.Name, p.Choices, value)
+	}
+	return nil
+}
+
+// Args holds the parameters of a component. Values are checked against the
+// declared kind when bound, so the getters never fail.
+type Args struct {
+	params []Param
+	values map[string]string
+}
+
+func (a Args) get(name string) string {
+	if value, ok := a.values[name]; ok {
+		return value
+	}
+	for _, p := range a.params {
+		if p.Name == name {
+			return p.Default
+		}
+	}
+	log.Panicf("undeclared parameter %s", name)
+	return ""
+}
+
+func (a Args) Int(name string) int {
+	value, _ := strconv.Atoi(a.get(name))
+	return value
+}
+
+func (a Args) Float(name string) float64 {
+	value, _ := strconv.ParseFloat(a.get(name), 64)
+	return value
+}
+
+func (a Args) String(name string) string {
+	return a.get(name)
+}
+
+func (a Args) Bool(name string) bool {
+	value, _ := strconv.ParseBool(a.get(name))
+	return value
+}
+
+type NetworkFactory struct {
+	Name   string
+	Usage  string
+	Params []Param
+	New    func(cfg *Config, args Args) Network
+}
+
+type MinerFactory struct {
+	Name   string
+	Usage  string
+	Params []Param
+	New    func(cfg *Config, args Args) Miner
+}
+
+var (
+	networkFactories = make(map[string]*NetworkFactory)
+	minerFactories   = make(map[string]*MinerFactory)
+)
+
+func RegisterNetwork(f *NetworkFactory) {
+	if _, ok := networkFactories[f.Name]; ok {
+		log.Panicf("network %s registered twice", f.Name)
+	}
+	networkFactories[f.Name] = f
+}
+
+func RegisterMiner(f *MinerFactory) {
+	if _, ok := minerFactories[f.Name]; ok {
+		log.Panicf("miner %s registered twice", f.Name)
+	}
+	minerFactories[f.Name] = f
+}
+
+func splitSpec(spec string) (string, []string) {
+	parts := strings.SplitN(spec, ":", 2)
+	name := strings.TrimSpace(parts[0])
+	if len(parts) == 1 || strings.TrimSpace(parts[1]) == "" {
+		return name, nil
+	}
+	args := strings.Split(parts[1], ",")
+	for i := range args {
+		args[i] = strings.TrimSpace(args[i])
+	}
+	return name, args
+}
+
+// bindArgs resolves the parameters of a component. The values from the scenario
+// file are applied first, and the arguments in the spec override them.
+func bindArgs(component string, params []Param, extra map[string]interface{}, raw []string) (Args, error) {
+	args := Args{params: params, values: make(map[string]string)}
+	declared := func(name string) *Param {
+		for i := range params {
+			if params[i].Name == name {
+				return &params[i]
+			}
+		}
+		return nil
+	}
+	set := func(name string, value string) error {
+		p := declared(name)
+		if p == nil {
+			return fmt.Errorf("%s has no parameter %s", component, name)
+		}
+		if err := p.check(value); err != nil {
+			return fmt.Errorf("%s: %v", component, err)
+		}
+		args.values[name] = value
+		return nil
+	}
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := set(name, paramString(extra[name])); err != nil {
+			return args, err
+		}
+	}
+
+	for pos, arg := range raw {
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 {
+			if err := set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+				return args, err
+			}
+			continue
+		}
+		if pos >= len(params) {
+			return args, fmt.Errorf("%s takes at most %d arguments", component, len(params))
+		}
+		if err := set(params[pos].Name, arg); err != nil {
+			return args, err
+		}
+	}
+	return args, nil
+}
+
+// paramString formats a value of a scenario file. JSON numbers are decoded as
+// float64, and fmt.Sprint prints 1000000 as "1e+06", which does not parse as an
+// integer.
+func paramString(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func lookupNetwork(spec string, extra map[string]interface{}) (*NetworkFactory, Args, error) {
+	name, raw := splitSpec(spec)
+	factory, ok := networkFactories[name]
+	if !ok {
+		return nil, Args{}, fmt.Errorf("unknown network %q", name)
+	}
+	args, err := bindArgs(name, factory.Params, extra, raw)
+	return factory, args, err
+}
+
+func lookupMiner(spec string, extra map[string]interface{}) (*MinerFactory, Args, error) {
+	name, raw := splitSpec(spec)
+	factory, ok := minerFactories[name]
+	if !ok {
+		return nil, Args{}, fmt.Errorf("unknown miner %q", name)
+	}
+	args, err := bindArgs(name, factory.Params, extra, raw)
+	return factory, args, err
+}
+
+func NewNetworkFromSpec(cfg *Config, spec string, extra map[string]interface{}) (Network, error) {
+	factory, args, err := lookupNetwork(spec, extra)
+	if err != nil {
+		return nil, err
+	}
+	return factory.New(cfg, args), nil
+}
+
+func NewMinerFromSpec(cfg *Config, spec string, extra map[string]interface{}) (Miner, error) {
+	factory, args, err := lookupMiner(spec, extra)
+	if err != nil {
+		return nil, err
+	}
+	return factory.New(cfg, args), nil
+}
+
+func writeParams(w io.Writer, params []Param) {
+	for _, p := range params {
+		detail := fmt.Sprintf("%s, default %q", p.Kind, p.Default)
+		if len(p.Choices) > 0 {
+			detail += fmt.Sprintf(", one of %s", strings.Join(p.Choices, "|"))
+		}
+		fmt.Fprintf(w, "      %-14s %s (%s)\n", p.Name, p.Usage, detail)
+	}
+}
+
+// ListComponents prints the registered networks and miners with their parameters.
+func ListComponents(w io.Writer) {
+	names := make([]string, 0, len(networkFactories))
+	for name := range networkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Networks:")
+	for _, name := range names {
+		f := networkFactories[name]
+		fmt.Fprintf(w, "  %-16s %s\n", f.Name, f.Usage)
+		writeParams(w, f.Params)
+	}
+
+	names = names[:0]
+	for name := range minerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Miners:")
+	for _, name := range names {
+		f := minerFactories[name]
+		fmt.Fprintf(w, "  %-16s %s\n", f.Name, f.Usage)
+		writeParams(w, f.Params)
+	}
+
+	listStopConditions(w)
+	listDifficultyAdjusters(w)
+	listForkChoices(w)
+}
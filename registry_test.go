@@ -0,0 +1,18 @@
+package simulator
+
+import "testing"
+
+// TestBindLargeIntegers checks that the integers of a scenario file, decoded as
+// float64, bind to integer parameters however large.
+func TestBindLargeIntegers(t *testing.T) {
+	_, args, err := lookupMiner("timewarp", map[string]interface{}{"window": float64(1000000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if window := args.Int("window"); window != 1000000 {
+		t.Fatalf("window %d, want 1000000", window)
+	}
+	if _, _, err := lookupMiner("timewarp", map[string]interface{}{"window": 2.5}); err == nil {
+		t.Fatal("a fractional window should be rejected")
+	}
+}
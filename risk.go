@@ -0,0 +1,210 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+)
+
+// ConfirmationRisk estimates the probability that the epoch of a block is
+// reverted, against an adversary with the given share of the hash power, at the
+// local time now of the node. It is 1 for a block which is not in the total
+// order yet.
+//
+// The epoch is reverted if a sibling of one of the pivot blocks up to it gets
+// heavier than the pivot block. For each of them the adversary starts behind by
+// the gap between the subtree weights of the pivot block and of its heaviest
+// sibling, and may have mined blocks in private since the fork at the block rate
+// observed in the graph. The risk is the chance it ever makes up the gap, the
+// gambler's ruin of the Bitcoin paper, summed over the pivot blocks.
+func (g *LocalGraph) ConfirmationRisk(block *Block, adversary float64, now int64) float64 {
+	g.updateOrder()
+	db := g.getDetailedBlock(block)
+	if db == nil || db.epoch < 0 {
+		return 1
+	}
+	return g.epochRisks(adversary, now, db.epoch)[db.epoch]
+}
+
+// epochRisks returns the confirmation risks of the epochs up to high, indexed by
+// pivot height. The total order must be up to date.
+func (g *LocalGraph) epochRisks(adversary float64, now int64, high int) []float64 {
+	rate := g.blockRate(now)
+	risks := make([]float64, high+1)
+	risk := 0.0
+	for height := 1; height <= high; height++ {
+		pivot := g.order.pivots[height]
+		sibling := 0
+		for _, child := range g.getAllChildren(pivot.parent) {
+			if child != pivot {
+				sibling = max(sibling, child.getWeight(g))
+			}
+		}
+		gap := pivot.getWeight(g) - sibling
+		withheld := adversary * rate * float64(now-pivot.parent.block.timestamp)
+		risk = math.Min(1, risk+catchUp(gap, withheld, adversary))
+		risks[height] = risk
+	}
+	return risks
+}
+
+// blockRate returns the blocks per time slot in the epochs of the last
+// recentEpochs pivot blocks, 0 if the pivot chain is only the genesis block.
+func (g *LocalGraph) blockRate(now int64) float64 {
+	tip := len(g.order.pivots) - 1
+	if tip == 0 {
+		return 0
+	}
+	first := max(0, tip-recentEpochs)
+	span := now - g.order.pivots[first].block.timestamp
+	if span <= 0 {
+		return 0
+	}
+	return float64(len(g.order.blocks)-g.order.start[first+1]) / float64(span)
+}
+
+// catchUp returns the probability that an adversary with a share q of the hash
+// power ever makes up a deficit of gap blocks, given it has mined a Poisson
+// number of blocks with the given mean in private. A tie counts as caught up.
+func catchUp(gap int, mean float64, q float64) float64 {
+	if gap <= 0 || q >= 0.5 {
+		return 1
+	}
+	if q <= 0 {
+		return 0
+	}
+	r := q / (1 - q)
+	if mean <= 0 {
+		return math.Pow(r, float64(gap))
+	}
+
+	// The blocks mined in private are within 10 standard deviations of the
+	// mean, the other terms are negligible.
+	spread := 10*math.Sqrt(mean) + 30
+	low, high := max(0, int(mean-spread)), int(mean+spread)
+	if float64(gap-high) > math.Log(1e-16)/math.Log(r) {
+		return 0
+	}
+	risk := 0.0
+	for k := low; k <= high; k++ {
+		lgamma, _ := math.Lgamma(float64(k + 1))
+		pmf := math.Exp(float64(k)*math.Log(mean) - mean - lgamma)
+		if k < gap {
+			risk += pmf * math.Pow(r, float64(gap-k))
+		} else {
+			risk += pmf
+		}
+	}
+	return math.Min(1, risk)
+}
+
+const riskWindow = 50 // Epochs below the pivot tip whose risk is predicted
+
+// riskBuckets are the upper bounds of the ranges of predicted risks reported by
+// the RiskValidator.
+var riskBuckets = []float64{1e-6, 1e-4, 1e-3, 1e-2, 0.1, 0.5, 1}
+
+type riskBucket struct {
+	count     int
+	predicted float64 // Sum of the predicted risks
+	reverted  int
+}
+
+// RiskValidator checks the confirmation risks computed by the observer miner,
+// whose fork choice must be a local graph, against the reversions of its pivot
+// chain later in the run. Every `every` blocks it predicts the risk of the last
+// riskWindow epochs; a prediction is reverted if the pivot block of its epoch
+// leaves the pivot chain afterwards. At the end the predictions are reported by
+// range of risk, with the share which was reverted. The predictions still
+// pending then count as not reverted, which is optimistic for the last ones.
+type RiskValidator struct {
+	BaseObserver
+	adversary float64
+	every     int
+
+	pending map[int][]float64 // Risks predicted for the pivot block at each height, while it stays on the pivot chain
+	buckets []riskBucket
+}
+
+func NewRiskValidator(adversary float64, every int) *RiskValidator {
+	return &RiskValidator{
+		adversary: adversary,
+		every:     every,
+		pending:   make(map[int][]float64),
+		buckets:   make([]riskBucket, len(riskBuckets)),
+	}
+}
+
+func (v *RiskValidator) BlockMined(o *Oracle, block *Block) {
+	if block.index%v.every != 0 {
+		return
+	}
+	g, ok := o.observerGraph().(*LocalGraph)
+	if !ok || g.pivotTip == nil {
+		return
+	}
+	g.updateOrder()
+	tip := g.pivotTip.block.height
+	risks := g.epochRisks(v.adversary, o.LocalTime(o.options.Observer), tip)
+	for height := max(1, tip-riskWindow+1); height <= tip; height++ {
+		v.pending[height] = append(v.pending[height], risks[height])
+	}
+}
+
+// PivotChanged resolves the predictions of the heights the observer reverts.
+func (v *RiskValidator) PivotChanged(o *Oracle, miner int, old *Block, new *Block) {
+	if miner != o.options.Observer || old == nil {
+		return
+	}
+	a, b := old, new
+	for a.height > b.height {
+		a = a.parent
+	}
+	for b.height > a.height {
+		b = b.parent
+	}
+	for a != b {
+		a, b = a.parent, b.parent
+	}
+	for height := a.height + 1; height <= old.height; height++ {
+		for _, risk := range v.pending[height] {
+			v.resolve(risk, true)
+		}
+		delete(v.pending, height)
+	}
+}
+
+func (v *RiskValidator) resolve(risk float64, reverted bool) {
+	idx := 0
+	for idx < len(riskBuckets)-1 && risk >= riskBuckets[idx] {
+		idx++
+	}
+	bucket := &v.buckets[idx]
+	bucket.count++
+	bucket.predicted += risk
+	if reverted {
+		bucket.reverted++
+	}
+}
+
+func (v *RiskValidator) SimulationEnd(o *Oracle) {
+	for _, risks := range v.pending {
+		for _, risk := range risks {
+			v.resolve(risk, false)
+		}
+	}
+	v.pending = make(map[int][]float64)
+
+	log.Warningf("Confirmation risk against %.0f%% of the hash power, predicted vs reverted:", v.adversary*100)
+	low := 0.0
+	for idx, bucket := range v.buckets {
+		high := fmt.Sprintf("%g)", riskBuckets[idx])
+		if idx == len(v.buckets)-1 {
+			high = "1]"
+		}
+		if bucket.count > 0 {
+			log.Warningf("  risk in [%g, %s: %d predictions, mean %.2e, reverted %d (%.2e)", low, high,
+				bucket.count, bucket.predicted/float64(bucket.count), bucket.reverted, ratio(bucket.reverted, bucket.count))
+		}
+		low = riskBuckets[idx]
+	}
+}
@@ -0,0 +1,88 @@
+package simulator
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+)
+
+// splitMix is a splitmix64 generator. Its whole state is one word, so a stream can
+// be stored and restored cheaply.
+type splitMix struct {
+	state uint64
+}
+
+func (s *splitMix) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+// deriveSeed mixes the master seed with the name of a stream.
+func deriveSeed(master int64, name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	mixer := &splitMix{state: uint64(master) ^ h.Sum64()}
+	return int64(mixer.Uint64())
+}
+
+func newStream(master int64, name string, sources *[]*splitMix) *rand.Rand {
+	source := &splitMix{state: uint64(deriveSeed(master, name))}
+	*sources = append(*sources, source)
+	return rand.New(source)
+}
+
+// RandStreams holds an independent random stream for each subsystem. All of them
+// are derived from one master seed, so two configurations with the same seed
+// share the block schedule and the topology even if they consume a different
+// number of draws for the link delays.
+type RandStreams struct {
+	Arrival  *rand.Rand // Block generation time
+	Miner    *rand.Rand // Miner of each block
+	Topology *rand.Rand // Peer connections
+	Geo      *rand.Rand // Location of nodes
+	Jitter   *rand.Rand // Random part of link delays
+	Clock    *rand.Rand // Clock offsets and drifts of the nodes
+
+	sources []*splitMix // In the order of the fields above
+}
+
+func NewRandStreams(seed int64) *RandStreams {
+	rs := &RandStreams{}
+	rs.Arrival = newStream(seed, "arrival", &rs.sources)
+	rs.Miner = newStream(seed, "miner", &rs.sources)
+	rs.Topology = newStream(seed, "topology", &rs.sources)
+	rs.Geo = newStream(seed, "geo", &rs.sources)
+	rs.Jitter = newStream(seed, "jitter", &rs.sources)
+	rs.Clock = newStream(seed, "clock", &rs.sources)
+	return rs
+}
+
+// states returns the position of every stream, restore moves them back there.
+func (rs *RandStreams) states() []uint64 {
+	states := make([]uint64, len(rs.sources))
+	for idx, source := range rs.sources {
+		states[idx] = source.state
+	}
+	return states
+}
+
+func (rs *RandStreams) restore(states []uint64) error {
+	if len(states) != len(rs.sources) {
+		return fmt.Errorf("%d random streams in the checkpoint, expect %d", len(states), len(rs.sources))
+	}
+	for idx, source := range rs.sources {
+		source.state = states[idx]
+	}
+	return nil
+}
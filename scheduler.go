@@ -0,0 +1,347 @@
+package simulator
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// Schedulers of the event queue, see OracleOptions.Queue. They pop the events in
+// the same order: by timestamp, then by insertion sequence.
+const (
+	HeapQueue     = "heap"
+	CalendarQueue = "calendar"
+)
+
+var QueueKinds = []string{HeapQueue, CalendarQueue}
+
+// scheduler keeps the pending events of an EventQueue. The queue assigns the
+// sequence numbers, the scheduler only orders the events.
+type scheduler interface {
+	Len() int
+	push(e Event)
+	pop() Event
+	peek() Event               // The next event to pop, the queue is not empty
+	remove(e *BaseEvent) Event // e is queued
+	fix(e *BaseEvent)          // The timestamp of the queued e has changed
+	each(f func(Event))
+}
+
+// NewEventQueue creates an empty queue with the given scheduler, "" for the heap.
+func NewEventQueue(kind string) (*EventQueue, error) {
+	switch kind {
+	case "", HeapQueue:
+		queue := make(EventPriorityQueue, 0)
+		return &EventQueue{sched: &heapScheduler{queue: queue}}, nil
+	case CalendarQueue:
+		return &EventQueue{sched: newCalendarScheduler()}, nil
+	}
+	return nil, fmt.Errorf("unknown event queue %q, expect one of %v", kind, QueueKinds)
+}
+
+type heapScheduler struct {
+	queue EventPriorityQueue
+}
+
+func (h *heapScheduler) Len() int {
+	return h.queue.Len()
+}
+
+func (h *heapScheduler) push(e Event) {
+	heap.Push(&h.queue, e)
+}
+
+func (h *heapScheduler) pop() Event {
+	return heap.Pop(&h.queue).(Event)
+}
+
+func (h *heapScheduler) peek() Event {
+	return h.queue[0]
+}
+
+func (h *heapScheduler) remove(e *BaseEvent) Event {
+	return heap.Remove(&h.queue, e.index).(Event)
+}
+
+func (h *heapScheduler) fix(e *BaseEvent) {
+	heap.Fix(&h.queue, e.index)
+}
+
+func (h *heapScheduler) each(f func(Event)) {
+	for _, e := range h.queue {
+		f(e)
+	}
+}
+
+const (
+	minCalendarBuckets = 16
+	calendarQuantile   = 0.9 // The later events are ignored when choosing the width
+)
+
+// calendarBucket holds the events of a bucket in two lanes. The events pushed in
+// order go to a FIFO: a block relay schedules thousands of packets at the same
+// time, and no width can split them. The others go to a heap on (timestamp, seq).
+type calendarBucket struct {
+	heap EventPriorityQueue
+	fifo []Event // nil for the removed events
+	head int     // First slot of fifo which may be live
+	live int     // Live events in fifo
+	// Order of the last event appended to fifo. It is copied, as ChangeTime
+	// sets the timestamp of an event before it is removed.
+	tailTime int64
+	tailSeq  uint64
+}
+
+// Events in the FIFO lane have a negative index: -1 for fifo[0], -2 for fifo[1]...
+
+func (b *calendarBucket) len() int {
+	return len(b.heap) + b.live
+}
+
+func (b *calendarBucket) push(e Event) {
+	x := e.base()
+	if b.live == 0 || b.tailTime < x.timestamp || b.tailTime == x.timestamp && b.tailSeq < x.seq {
+		if b.live == 0 {
+			b.fifo, b.head = b.fifo[:0], 0
+		}
+		b.fifo = append(b.fifo, e)
+		x.index = -len(b.fifo)
+		b.live++
+		b.tailTime, b.tailSeq = x.timestamp, x.seq
+		return
+	}
+	heap.Push(&b.heap, e)
+}
+
+// first returns the earliest event, nil if the bucket is empty.
+func (b *calendarBucket) first() Event {
+	var first Event
+	if b.live > 0 {
+		for b.fifo[b.head] == nil {
+			b.head++
+		}
+		first = b.fifo[b.head]
+	}
+	if len(b.heap) > 0 && (first == nil || eventBefore(b.heap[0], first)) {
+		first = b.heap[0]
+	}
+	return first
+}
+
+func (b *calendarBucket) pop() Event {
+	first := b.first()
+	if first.base().index >= 0 {
+		return heap.Pop(&b.heap).(Event)
+	}
+	b.fifo[b.head] = nil
+	b.head++
+	b.live--
+	if b.head > 64 && b.head > len(b.fifo)/2 {
+		b.compact()
+	}
+	return first
+}
+
+func (b *calendarBucket) remove(e *BaseEvent) Event {
+	if e.index >= 0 {
+		return heap.Remove(&b.heap, e.index).(Event)
+	}
+	pos := -e.index - 1
+	removed := b.fifo[pos]
+	b.fifo[pos] = nil
+	b.live--
+	return removed
+}
+
+// compact drops the popped slots at the front of the FIFO.
+func (b *calendarBucket) compact() {
+	n := copy(b.fifo, b.fifo[b.head:])
+	for i := n; i < len(b.fifo); i++ {
+		b.fifo[i] = nil
+	}
+	b.fifo, b.head = b.fifo[:n], 0
+	for pos, e := range b.fifo {
+		if e != nil {
+			e.base().index = -pos - 1
+		}
+	}
+}
+
+func (b *calendarBucket) each(f func(Event)) {
+	for _, e := range b.fifo[b.head:] {
+		if e != nil {
+			f(e)
+		}
+	}
+	for _, e := range b.heap {
+		f(e)
+	}
+}
+
+// calendarScheduler is a calendar queue (R. Brown, 1988). The time is cut into
+// buckets of the same width, and a bucket holds the events of every "year"
+// falling in it. Popping scans the buckets from the current one, so an event
+// costs O(1) on average when the width matches the density of the events. The
+// number of buckets follows the number of events, and the width is re-estimated
+// whenever they are resized.
+type calendarScheduler struct {
+	buckets []calendarBucket
+	width   int64
+	size    int
+
+	current int   // Bucket of the last popped event
+	top     int64 // End of the window of the current bucket in the current year
+	last    int64 // Timestamp of the last popped event
+}
+
+func newCalendarScheduler() *calendarScheduler {
+	c := &calendarScheduler{width: 1}
+	c.buckets = make([]calendarBucket, minCalendarBuckets)
+	c.seek(0)
+	return c
+}
+
+func (c *calendarScheduler) Len() int {
+	return c.size
+}
+
+func (c *calendarScheduler) bucket(timestamp int64) int {
+	return int((timestamp / c.width) % int64(len(c.buckets)))
+}
+
+// seek moves the scan to the window holding timestamp.
+func (c *calendarScheduler) seek(timestamp int64) {
+	c.current = c.bucket(timestamp)
+	c.top = (timestamp/c.width + 1) * c.width
+}
+
+func (c *calendarScheduler) insert(e Event) {
+	b := c.bucket(e.GetTimestamp())
+	e.base().bucket = b
+	c.buckets[b].push(e)
+	c.size++
+}
+
+func (c *calendarScheduler) push(e Event) {
+	c.insert(e)
+	// The oracle never schedules an event in the past, but a restored queue or a
+	// queue used on its own may.
+	if e.GetTimestamp() < c.top-c.width {
+		c.seek(e.GetTimestamp())
+	}
+	if c.size > 2*len(c.buckets) {
+		c.resize(2 * len(c.buckets))
+	}
+}
+
+func (c *calendarScheduler) pop() Event {
+	return c.take(c.next())
+}
+
+func (c *calendarScheduler) peek() Event {
+	return c.buckets[c.next()].first()
+}
+
+// next moves the scan to the bucket holding the earliest event and returns it.
+func (c *calendarScheduler) next() int {
+	n := len(c.buckets)
+	b, top := c.current, c.top
+	for i := 0; i < n; i++ {
+		if first := c.buckets[b].first(); first != nil && first.GetTimestamp() < top {
+			c.current, c.top = b, top
+			return b
+		}
+		b++
+		if b == n {
+			b = 0
+		}
+		top += c.width
+	}
+
+	// No event in the next year, jump to the earliest one.
+	best := -1
+	var earliest Event
+	for b := range c.buckets {
+		if first := c.buckets[b].first(); first != nil && (earliest == nil || eventBefore(first, earliest)) {
+			best, earliest = b, first
+		}
+	}
+	c.seek(earliest.GetTimestamp())
+	return best
+}
+
+func (c *calendarScheduler) take(b int) Event {
+	e := c.buckets[b].pop()
+	c.size--
+	c.last = e.GetTimestamp()
+	if c.size < len(c.buckets)/2 && len(c.buckets) > minCalendarBuckets {
+		c.resize(len(c.buckets) / 2)
+	}
+	return e
+}
+
+func (c *calendarScheduler) remove(e *BaseEvent) Event {
+	removed := c.buckets[e.bucket].remove(e)
+	c.size--
+	return removed
+}
+
+func (c *calendarScheduler) fix(e *BaseEvent) {
+	// The bucket depends on the timestamp, so the event is inserted again. It
+	// keeps its sequence number.
+	c.push(c.remove(e))
+}
+
+func (c *calendarScheduler) each(f func(Event)) {
+	for b := range c.buckets {
+		c.buckets[b].each(f)
+	}
+}
+
+// resize rebuilds the calendar with n buckets. The width holds three distinct
+// timestamps on average, measured on the earliest 90% of the events: the far
+// ones, e.g. the next block or a timeout, would make the buckets too wide. The
+// events sharing a timestamp are cheap in the FIFO lane, so they are counted
+// once. Brown measures the gaps between the first events instead, which is
+// fooled by the bursts of a block relay.
+func (c *calendarScheduler) resize(n int) {
+	events := make([]Event, 0, c.size)
+	c.each(func(e Event) {
+		events = append(events, e)
+	})
+	sort.Slice(events, func(i, j int) bool {
+		return eventBefore(events[i], events[j])
+	})
+
+	if k := int(float64(len(events)) * calendarQuantile); k > 0 {
+		distinct := 0
+		for i := 1; i <= k; i++ {
+			if events[i].GetTimestamp() != events[i-1].GetTimestamp() {
+				distinct++
+			}
+		}
+		if distinct > 0 {
+			span := events[k].GetTimestamp() - events[0].GetTimestamp()
+			c.width = max(3*span/int64(distinct), 1)
+		}
+	}
+
+	c.buckets = make([]calendarBucket, n)
+	c.size = 0
+	for _, e := range events {
+		c.insert(e)
+	}
+	start := c.last
+	if len(events) > 0 && events[0].GetTimestamp() < start {
+		start = events[0].GetTimestamp()
+	}
+	c.seek(start)
+}
+
+// eventBefore is the order of the event queue.
+func eventBefore(a Event, b Event) bool {
+	if a.GetTimestamp() != b.GetTimestamp() {
+		return a.GetTimestamp() < b.GetTimestamp()
+	}
+	return a.GetSeq() < b.GetSeq()
+}
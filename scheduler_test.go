@@ -0,0 +1,289 @@
+package simulator
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type testEvent struct {
+	BaseEvent
+	id int
+}
+
+func (e *testEvent) Run(o *Oracle) []Event {
+	return nil
+}
+
+func newTestQueue(t testing.TB, kind string) *EventQueue {
+	t.Helper()
+	queue, err := NewEventQueue(kind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+// pushTest pushes a new event with the given id and timestamp.
+func pushTest(queue *EventQueue, id int, timestamp int64) *testEvent {
+	e := &testEvent{BaseEvent: BaseEvent{timestamp: timestamp}, id: id}
+	queue.Push(e)
+	return e
+}
+
+func popIDs(queue *EventQueue) []int {
+	var ids []int
+	for queue.Len() > 0 {
+		ids = append(ids, queue.Pop().(*testEvent).id)
+	}
+	return ids
+}
+
+func equalIDs(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestSchedulersAgree runs the same random operations on the heap and the
+// calendar queue and compares the popped events. The timestamps mix bursts, as
+// in a block relay, close and far events, and events in the past of the last
+// pop. The queue grows and drains in phases, so the calendar is resized both
+// ways.
+func TestSchedulersAgree(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		heapQueue := newTestQueue(t, HeapQueue)
+		calendar := newTestQueue(t, CalendarQueue)
+		sched := calendar.sched.(*calendarScheduler)
+
+		// The pending events, as pairs of the same event in both queues.
+		var pending [][2]*testEvent
+		forget := func(i int) {
+			pending[i] = pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+		}
+		now, id := int64(0), 0
+		grew, shrank := false, false
+		for phase := 0; phase < 6; phase++ {
+			growing := phase%2 == 0
+			for step := 0; step < 3000; step++ {
+				op := rng.Intn(10)
+				switch {
+				case op < 5 && growing || op < 2:
+					var timestamp int64
+					switch rng.Intn(6) {
+					case 0, 1:
+						timestamp = now
+					case 2, 3:
+						timestamp = now + rng.Int63n(100)
+					case 4:
+						timestamp = now + rng.Int63n(1000000)
+					default:
+						timestamp = max(now-rng.Int63n(50), 0)
+					}
+					id++
+					pending = append(pending, [2]*testEvent{
+						pushTest(heapQueue, id, timestamp),
+						pushTest(calendar, id, timestamp),
+					})
+				case op < 7 && len(pending) > 0:
+					i := rng.Intn(len(pending))
+					if rng.Intn(2) == 0 {
+						heapQueue.Cancel(pending[i][0])
+						calendar.Cancel(pending[i][1])
+						forget(i)
+						break
+					}
+					timestamp := max(pending[i][0].timestamp+rng.Int63n(200)-100, 0)
+					pending[i][0].ChangeTime(timestamp)
+					pending[i][1].ChangeTime(timestamp)
+				case heapQueue.Len() > 0:
+					a, b := heapQueue.Pop().(*testEvent), calendar.Pop().(*testEvent)
+					if a.id != b.id {
+						t.Fatalf("seed %d: heap popped %d at %d, calendar popped %d at %d", seed, a.id, a.timestamp, b.id, b.timestamp)
+					}
+					now = a.timestamp
+					for i := range pending {
+						if pending[i][0] == a {
+							forget(i)
+							break
+						}
+					}
+				}
+				if heapQueue.Len() != calendar.Len() {
+					t.Fatalf("seed %d: heap holds %d events, calendar %d", seed, heapQueue.Len(), calendar.Len())
+				}
+				if len(sched.buckets) > 4*minCalendarBuckets {
+					grew = true
+				} else if grew && len(sched.buckets) == minCalendarBuckets {
+					shrank = true
+				}
+			}
+		}
+		if a, b := popIDs(heapQueue), popIDs(calendar); !equalIDs(a, b) {
+			t.Fatalf("seed %d: the queues drain differently", seed)
+		}
+		if !grew || !shrank {
+			t.Fatalf("seed %d: the calendar was not resized both ways", seed)
+		}
+	}
+}
+
+func TestCalendarFIFOLane(t *testing.T) {
+	queue := newTestQueue(t, CalendarQueue)
+	sched := queue.sched.(*calendarScheduler)
+	var events []*testEvent
+	for id := 0; id < 10; id++ {
+		events = append(events, pushTest(queue, id, 20))
+	}
+	bucket := &sched.buckets[sched.bucket(20)]
+	if len(bucket.heap) != 0 || bucket.live != 10 {
+		t.Fatalf("a burst should go to the FIFO lane, heap %d, fifo %d", len(bucket.heap), bucket.live)
+	}
+	for pos, e := range events {
+		if e.index != -pos-1 {
+			t.Fatalf("event %d has index %d in the FIFO lane", pos, e.index)
+		}
+	}
+
+	// An event out of order goes to the heap lane of the same bucket, and
+	// still pops first.
+	pushTest(queue, 10, 4)
+	if len(bucket.heap) != 1 {
+		t.Fatalf("an event out of order should go to the heap lane")
+	}
+	queue.Cancel(events[3])
+	queue.Cancel(events[0])
+	want := []int{10, 1, 2, 4, 5, 6, 7, 8, 9}
+	if got := popIDs(queue); !equalIDs(got, want) {
+		t.Fatalf("popped %v, want %v", got, want)
+	}
+}
+
+func TestCalendarCompact(t *testing.T) {
+	queue := newTestQueue(t, CalendarQueue)
+	sched := queue.sched.(*calendarScheduler)
+	var events []*testEvent
+	for id := 0; id < 200; id++ {
+		events = append(events, pushTest(queue, id, 7))
+	}
+	// The FIFO lane is compacted once more than half of it has been popped.
+	for i := 0; i < 101; i++ {
+		queue.Pop()
+	}
+	bucket := &sched.buckets[sched.bucket(7)]
+	if bucket.head != 0 || len(bucket.fifo) != 99 {
+		t.Fatalf("the FIFO lane should be compacted, head %d, length %d", bucket.head, len(bucket.fifo))
+	}
+	for pos, e := range events[101:] {
+		if e.index != -pos-1 {
+			t.Fatalf("event %d has index %d after the compaction, want %d", e.id, e.index, -pos-1)
+		}
+	}
+	// The indices are still valid for removal.
+	queue.Cancel(events[150])
+	got := popIDs(queue)
+	if len(got) != 98 || got[0] != 101 || got[48] != 149 || got[49] != 151 {
+		t.Fatalf("popped %v after the compaction", got)
+	}
+}
+
+// TestCalendarFix checks that a fixed event keeps its sequence number, so it is
+// ordered with the events of its new timestamp by its original push.
+func TestCalendarFix(t *testing.T) {
+	for _, kind := range QueueKinds {
+		queue := newTestQueue(t, kind)
+		a := pushTest(queue, 0, 20)
+		pushTest(queue, 1, 10)
+		c := pushTest(queue, 2, 30)
+		seq := a.seq
+		a.ChangeTime(10)
+		c.ChangeTime(5)
+		if a.seq != seq {
+			t.Fatalf("%s: the fixed event got the sequence number %d, had %d", kind, a.seq, seq)
+		}
+		want := []int{2, 0, 1}
+		if got := popIDs(queue); !equalIDs(got, want) {
+			t.Fatalf("%s: popped %v, want %v", kind, got, want)
+		}
+	}
+}
+
+func TestCalendarPushInPast(t *testing.T) {
+	queue := newTestQueue(t, CalendarQueue)
+	for id := 0; id < 5; id++ {
+		pushTest(queue, id, 1000+int64(id)*100)
+	}
+	queue.Pop()
+	queue.Pop()
+	pushTest(queue, 5, 10)
+	pushTest(queue, 6, 1150)
+	want := []int{5, 6, 2, 3, 4}
+	if got := popIDs(queue); !equalIDs(got, want) {
+		t.Fatalf("popped %v, want %v", got, want)
+	}
+}
+
+// TestCalendarWidth checks the width estimate: three distinct timestamps per
+// bucket on the earliest 90% of the events, a burst counting once.
+func TestCalendarWidth(t *testing.T) {
+	sched := newCalendarScheduler()
+	seq := uint64(0)
+	add := func(timestamp int64) {
+		e := &testEvent{BaseEvent: BaseEvent{timestamp: timestamp, seq: seq}}
+		seq++
+		sched.insert(e)
+	}
+	// 40 timestamps 10 apart, 5 events each, and 20 far events.
+	for i := int64(0); i < 40; i++ {
+		for j := 0; j < 5; j++ {
+			add(i * 10)
+		}
+	}
+	for i := int64(0); i < 20; i++ {
+		add(1000000000 + i)
+	}
+	sched.resize(64)
+	if sched.width != 30 {
+		t.Fatalf("width %d, want 30", sched.width)
+	}
+	if len(sched.buckets) != 64 || sched.Len() != 220 {
+		t.Fatalf("%d buckets with %d events after the resize", len(sched.buckets), sched.Len())
+	}
+}
+
+// benchmarkQueue runs the hold model: the queue keeps 10000 events, and each
+// step pops one and pushes a later one, every fourth in a burst at the same
+// time.
+func benchmarkQueue(b *testing.B, kind string) {
+	queue := newTestQueue(b, kind)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		pushTest(queue, i, rng.Int63n(100000))
+	}
+	events := make([]testEvent, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now := queue.Pop().GetTimestamp()
+		e := &events[i]
+		if i%4 != 0 {
+			now += rng.Int63n(100000)
+		}
+		e.timestamp = now
+		queue.Push(e)
+	}
+}
+
+func BenchmarkHeapQueue(b *testing.B) {
+	benchmarkQueue(b, HeapQueue)
+}
+
+func BenchmarkCalendarQueue(b *testing.B) {
+	benchmarkQueue(b, CalendarQueue)
+}
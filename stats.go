@@ -0,0 +1,88 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+)
+
+// Replica is one run of a multi-replica experiment.
+type Replica struct {
+	Seed    int64    `json:"seed"`
+	Metrics *Metrics `json:"metrics"`
+}
+
+// Stat summarizes the values of a metric over the replicas.
+type Stat struct {
+	Mean float64 `json:"mean"`
+	Std  float64 `json:"std"` // Sample standard deviation
+	Low  float64 `json:"low"` // 95% confidence interval of the mean
+	High float64 `json:"high"`
+}
+
+// ReplicaSeed derives the seed of the i-th replica from the master seed, so the
+// replicas of a scenario are the same on every machine. The seed is positive, so
+// a replica can be run alone with -seed.
+func ReplicaSeed(master int64, i int) int64 {
+	return deriveSeed(master, fmt.Sprintf("replica/%d", i)) & math.MaxInt64
+}
+
+// tTable holds the two-sided 95% quantiles of the Student t distribution for 1
+// to 30 degrees of freedom.
+var tTable = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+func tQuantile(df int) float64 {
+	switch {
+	case df <= len(tTable):
+		return tTable[df-1]
+	case df <= 40:
+		return 2.021
+	case df <= 60:
+		return 2.000
+	case df <= 120:
+		return 1.980
+	}
+	return 1.960
+}
+
+// Summarize computes the mean, the standard deviation and the 95% confidence
+// interval of the mean. The interval is empty for a single value.
+func Summarize(values []float64) Stat {
+	n := len(values)
+	if n == 0 {
+		return Stat{}
+	}
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	stat := Stat{Mean: sum / float64(n)}
+	if n == 1 {
+		stat.Low, stat.High = stat.Mean, stat.Mean
+		return stat
+	}
+	squares := 0.0
+	for _, value := range values {
+		squares += (value - stat.Mean) * (value - stat.Mean)
+	}
+	stat.Std = math.Sqrt(squares / float64(n-1))
+	half := tQuantile(n-1) * stat.Std / math.Sqrt(float64(n))
+	stat.Low, stat.High = stat.Mean-half, stat.Mean+half
+	return stat
+}
+
+// SummarizeReplicas summarizes every metric, in the order of MetricNames.
+func SummarizeReplicas(replicas []*Replica) []Stat {
+	stats := make([]Stat, len(MetricNames))
+	for idx := range MetricNames {
+		values := make([]float64, len(replicas))
+		for i, replica := range replicas {
+			values[i] = replica.Metrics.Values()[idx]
+		}
+		stats[idx] = Summarize(values)
+	}
+	return stats
+}
@@ -0,0 +1,357 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// StopCondition decides when a run ends. Stop is called before each event, with
+// the timestamp of the oracle set to the one of the event. Once it returns true,
+// the oracle stops mining and drains the queue, so every block mined so far is
+// delivered before the final statistics.
+type StopCondition interface {
+	Stop(o *Oracle) bool
+	String() string
+}
+
+type allOf []StopCondition
+
+// And stops when all the conditions hold at the same time.
+func And(conditions ...StopCondition) StopCondition {
+	return allOf(conditions)
+}
+
+func (c allOf) Stop(o *Oracle) bool {
+	stop := true
+	// Every condition is evaluated, as in anyOf, so a wall clock starts with the
+	// run and a convergence test sees all the samples.
+	for _, condition := range c {
+		if !condition.Stop(o) {
+			stop = false
+		}
+	}
+	return stop
+}
+
+func (c allOf) String() string {
+	names := make([]string, len(c))
+	for idx, condition := range c {
+		names[idx] = condition.String()
+	}
+	return strings.Join(names, "&")
+}
+
+type anyOf []StopCondition
+
+// Or stops when any of the conditions holds.
+func Or(conditions ...StopCondition) StopCondition {
+	return anyOf(conditions)
+}
+
+func (c anyOf) Stop(o *Oracle) bool {
+	stop := false
+	// Every condition is evaluated, so the stateful ones see all the events.
+	for _, condition := range c {
+		if condition.Stop(o) {
+			stop = true
+		}
+	}
+	return stop
+}
+
+func (c anyOf) String() string {
+	names := make([]string, len(c))
+	for idx, condition := range c {
+		names[idx] = condition.String()
+	}
+	return strings.Join(names, "|")
+}
+
+type maxTime struct {
+	limit int64
+	sec   float64
+}
+
+// MaxTime stops at the first event after sec seconds of simulated time.
+func MaxTime(sec float64) StopCondition {
+	return &maxTime{limit: -1, sec: sec}
+}
+
+func (c *maxTime) Stop(o *Oracle) bool {
+	if c.limit < 0 {
+		c.limit = int64(c.sec * o.timePrecision)
+	}
+	return o.timestamp > c.limit
+}
+
+func (c *maxTime) String() string {
+	return fmt.Sprintf("time:%g", c.sec)
+}
+
+type maxBlocks int
+
+// MaxBlocks stops once n blocks have been mined.
+func MaxBlocks(n int) StopCondition {
+	return maxBlocks(n)
+}
+
+func (c maxBlocks) Stop(o *Oracle) bool {
+	return o.mined >= int(c)
+}
+
+func (c maxBlocks) String() string {
+	return fmt.Sprintf("blocks:%d", int(c))
+}
+
+type pivotHeight int
+
+// PivotHeight stops once the pivot chain of the observer reaches height h.
+func PivotHeight(h int) StopCondition {
+	return pivotHeight(h)
+}
+
+func (c pivotHeight) Stop(o *Oracle) bool {
+	return o.PivotHeight() >= int(c)
+}
+
+func (c pivotHeight) String() string {
+	return fmt.Sprintf("height:%d", int(c))
+}
+
+type blockConfirmed struct {
+	block     int
+	depth     int
+	mined     int
+	confirmed *Set // Miners which have confirmed the block
+}
+
+// BlockConfirmed stops once every honest miner (every miner with a local graph)
+// has the block in the past of a pivot block at least depth blocks below its
+// pivot tip. It is checked whenever a block is mined; a miner which has
+// confirmed the block is not checked again.
+func BlockConfirmed(block int, depth int) StopCondition {
+	return &blockConfirmed{block: block, depth: depth, mined: -1, confirmed: NewSet()}
+}
+
+func (c *blockConfirmed) Stop(o *Oracle) bool {
+	if o.mined == c.mined {
+		return false
+	}
+	c.mined = o.mined
+	if c.block >= len(o.blocks) {
+		return false
+	}
+	block := o.blocks[c.block]
+	for id, miner := range o.miners.miners {
+		if c.confirmed.Has(id) {
+			continue
+		}
+		graphMiner, ok := miner.(interface{ Graph() ForkChoice })
+		if !ok {
+			continue
+		}
+		if !confirms(graphMiner.Graph(), block, c.depth) {
+			return false
+		}
+		c.confirmed.Add(id)
+	}
+	return true
+}
+
+func (c *blockConfirmed) String() string {
+	return fmt.Sprintf("confirmed:%d,depth=%d", c.block, c.depth)
+}
+
+type wallClock struct {
+	limit time.Duration
+	start time.Time
+}
+
+// WallClock stops after the run has taken limit of real time.
+func WallClock(limit time.Duration) StopCondition {
+	return &wallClock{limit: limit}
+}
+
+func (c *wallClock) Stop(o *Oracle) bool {
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+	return time.Since(c.start) >= c.limit
+}
+
+func (c *wallClock) String() string {
+	return fmt.Sprintf("wall:%s", c.limit)
+}
+
+type metricConverged struct {
+	metric    int // Index in MetricNames
+	tolerance float64
+	every     int
+	window    int
+	mined     int
+	values    []float64
+}
+
+// MetricConverged computes a metric of the observer every `every` mined blocks,
+// and stops when the last `window` values are within tolerance of each other.
+func MetricConverged(metric string, tolerance float64, every int, window int) (StopCondition, error) {
+	for idx, name := range MetricNames {
+		if name == metric {
+			return &metricConverged{metric: idx, tolerance: tolerance, every: every, window: window}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown metric %q, expect one of %v", metric, MetricNames)
+}
+
+func (c *metricConverged) Stop(o *Oracle) bool {
+	if o.mined == c.mined || o.mined%c.every != 0 {
+		return false
+	}
+	c.mined = o.mined
+	metrics, err := o.Metrics()
+	if err != nil {
+		return false
+	}
+	c.values = append(c.values, metrics.Values()[c.metric])
+	if len(c.values) > c.window {
+		c.values = c.values[1:]
+	}
+	if len(c.values) < c.window {
+		return false
+	}
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, value := range c.values {
+		low, high = math.Min(low, value), math.Max(high, value)
+	}
+	return high-low <= c.tolerance
+}
+
+func (c *metricConverged) String() string {
+	return fmt.Sprintf("converge:%s,tolerance=%g,every=%d,window=%d", MetricNames[c.metric], c.tolerance, c.every, c.window)
+}
+
+// Stop conditions are given by specs in the same form as the components, e.g.
+// "blocks:1000" or "converge:antiset,tolerance=0.1". Specs are combined with '&'
+// and '|', '&' binds tighter: "height:500&wall:10m|blocks:2000".
+
+type stopFactory struct {
+	name   string
+	usage  string
+	params []Param
+	new    func(args Args) (StopCondition, error)
+}
+
+var stopFactories = []*stopFactory{
+	{
+		name:   "time",
+		usage:  "Simulated time",
+		params: []Param{{Name: "sec", Kind: FloatParam, Default: "25000", Usage: "Seconds"}},
+		new: func(args Args) (StopCondition, error) {
+			return MaxTime(args.Float("sec")), nil
+		},
+	},
+	{
+		name:   "blocks",
+		usage:  "Number of mined blocks",
+		params: []Param{{Name: "n", Kind: IntParam, Default: "5000", Usage: "Blocks"}},
+		new: func(args Args) (StopCondition, error) {
+			return MaxBlocks(args.Int("n")), nil
+		},
+	},
+	{
+		name:   "height",
+		usage:  "Height of the pivot chain of the observer",
+		params: []Param{{Name: "h", Kind: IntParam, Default: "1000", Usage: "Height"}},
+		new: func(args Args) (StopCondition, error) {
+			return PivotHeight(args.Int("h")), nil
+		},
+	},
+	{
+		name:  "confirmed",
+		usage: "A block is confirmed by every honest miner",
+		params: []Param{
+			{Name: "block", Kind: IntParam, Default: "1", Usage: "Block index"},
+			{Name: "depth", Kind: IntParam, Default: "6", Usage: "Pivot blocks above the epoch of the block"},
+		},
+		new: func(args Args) (StopCondition, error) {
+			return BlockConfirmed(args.Int("block"), args.Int("depth")), nil
+		},
+	},
+	{
+		name:   "wall",
+		usage:  "Real time budget",
+		params: []Param{{Name: "limit", Kind: StringParam, Default: "1h", Usage: "Duration, e.g. 90s or 10m"}},
+		new: func(args Args) (StopCondition, error) {
+			limit, err := time.ParseDuration(args.String("limit"))
+			if err != nil {
+				return nil, err
+			}
+			return WallClock(limit), nil
+		},
+	},
+	{
+		name:  "converge",
+		usage: "A metric of the observer converges",
+		params: []Param{
+			{Name: "metric", Kind: StringParam, Default: "antiset", Choices: MetricNames, Usage: "Metric"},
+			{Name: "tolerance", Kind: FloatParam, Default: "0.01", Usage: "Maximum spread of the window"},
+			{Name: "every", Kind: IntParam, Default: "50", Usage: "Mined blocks between two samples"},
+			{Name: "window", Kind: IntParam, Default: "5", Usage: "Number of samples"},
+		},
+		new: func(args Args) (StopCondition, error) {
+			if args.Int("every") <= 0 || args.Int("window") <= 0 {
+				return nil, fmt.Errorf("every and window must be positive")
+			}
+			return MetricConverged(args.String("metric"), args.Float("tolerance"), args.Int("every"), args.Int("window"))
+		},
+	},
+}
+
+func parseStopSpec(spec string) (StopCondition, error) {
+	name, raw := splitSpec(spec)
+	for _, f := range stopFactories {
+		if f.name == name {
+			args, err := bindArgs(name, f.params, nil, raw)
+			if err != nil {
+				return nil, err
+			}
+			return f.new(args)
+		}
+	}
+	return nil, fmt.Errorf("unknown stop condition %q", name)
+}
+
+// ParseStopCondition builds the stop condition described by spec.
+func ParseStopCondition(spec string) (StopCondition, error) {
+	var alternatives []StopCondition
+	for _, part := range strings.Split(spec, "|") {
+		var conditions []StopCondition
+		for _, item := range strings.Split(part, "&") {
+			condition, err := parseStopSpec(item)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, condition)
+		}
+		if len(conditions) == 1 {
+			alternatives = append(alternatives, conditions[0])
+		} else {
+			alternatives = append(alternatives, And(conditions...))
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return Or(alternatives...), nil
+}
+
+func listStopConditions(w io.Writer) {
+	fmt.Fprintln(w, "Stop conditions (combine with & and |):")
+	for _, f := range stopFactories {
+		fmt.Fprintf(w, "  %-16s %s\n", f.name, f.usage)
+		writeParams(w, f.params)
+	}
+}
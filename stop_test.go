@@ -0,0 +1,37 @@
+package simulator
+
+import "testing"
+
+// countedStop counts its calls and returns a fixed answer.
+type countedStop struct {
+	stop  bool
+	calls int
+}
+
+func (c *countedStop) Stop(o *Oracle) bool {
+	c.calls++
+	return c.stop
+}
+
+func (c *countedStop) String() string {
+	return "counted"
+}
+
+// TestCombinedStopEvaluatesAll checks that And and Or call every condition, so
+// the stateful ones see all the events.
+func TestCombinedStopEvaluatesAll(t *testing.T) {
+	for _, combine := range []func(...StopCondition) StopCondition{And, Or} {
+		first, second := &countedStop{stop: false}, &countedStop{stop: true}
+		condition := combine(first, second)
+		for i := 0; i < 3; i++ {
+			condition.Stop(nil)
+		}
+		if first.calls != 3 || second.calls != 3 {
+			t.Errorf("%s: the conditions were called %d and %d times, want 3", condition, first.calls, second.calls)
+		}
+	}
+	first, second := &countedStop{stop: false}, &countedStop{stop: true}
+	if And(first, second).Stop(nil) || !Or(first, second).Stop(nil) {
+		t.Error("And should not stop and Or should stop on false and true")
+	}
+}
@@ -1,4 +1,6 @@
-package main
+package simulator
+
+import "container/list"
 
 // This file contains function for correctness check. You don't need to read the details.
 
@@ -22,8 +24,7 @@ func (g *LocalGraph) checkConsistency() {
 		}
 
 		children := g.getAllChildren(block)
-		totalWeight := 1
-		maxWeight := 0.0
+		totalWeight := g.blockWeight(block.block)
 		var maxblock *DetailedBlock
 		maxblock = nil
 
@@ -41,7 +42,7 @@ func (g *LocalGraph) checkConsistency() {
 			}
 
 			if child.isPivot() {
-				totalWeight = totalWeight + child.weight + g.totalWeight
+				totalWeight = totalWeight + child.weight + g.weightSum
 				if !block.isPivot() || child != block.maxChild {
 					log.Fatal("local graph error: mark non-pivot block as pivot")
 				}
@@ -52,15 +53,14 @@ func (g *LocalGraph) checkConsistency() {
 				}
 			}
 
-			if maxWeight < child.getWeight(g) {
-				maxWeight = child.getWeight(g)
+			if maxblock == nil || g.heavier(child, maxblock) {
 				maxblock = child
 			}
 		}
 		if block.maxChild != maxblock {
 			log.Fatalf("local graph error: max child consistency, say %v, find %v", block.maxChild, maxblock)
 		}
-		if block.isPivot() && totalWeight != block.weight+g.totalWeight {
+		if block.isPivot() && totalWeight != block.weight+g.weightSum {
 			log.Fatalf("block %d, local graph error: weight consistency", block.block.index)
 		}
 		if !block.isPivot() && totalWeight != block.weight {
@@ -83,3 +83,65 @@ func (g *LocalGraph) checkConsistency() {
 	}
 }
 
+// checkOrder compares the total order and its epochs with the ones computed from
+// scratch.
+func (g *LocalGraph) checkOrder() {
+	g.updateOrder()
+	blocks := append([]*Block(nil), g.order.blocks...)
+	kept := g.order.kept
+
+	for _, block := range g.ledger {
+		block.epoch = -1
+	}
+	g.order = totalOrder{}
+	g.updateOrder()
+	g.order.kept = kept
+
+	if len(blocks) != len(g.order.blocks) {
+		log.Fatalf("local graph error: %d blocks in the total order, expect %d", len(blocks), len(g.order.blocks))
+	}
+	for idx, block := range blocks {
+		if block != g.order.blocks[idx] {
+			log.Fatalf("local graph error: total order differs at %d", idx)
+		}
+	}
+	epochs, _ := g.epochsFromScratch()
+	for index, epoch := range epochs {
+		if g.ledger[index].epoch != epoch {
+			log.Fatalf("local graph error: block %d in epoch %d, expect %d", index, g.ledger[index].epoch, epoch)
+		}
+	}
+}
+
+// epochsFromScratch computes the epochs by a search from each pivot block, to
+// check the ones maintained with the total order.
+func (g *LocalGraph) epochsFromScratch() (map[int]int, CountMap) {
+	epochs := make(map[int]int)
+	epochCnt := make(CountMap)
+
+	pivotBlock := g.genesis
+
+	epochs[pivotBlock.block.index] = 0
+	for pivotBlock.maxChild != nil {
+		pivotBlock = pivotBlock.maxChild
+		visitList := list.New()
+		epoch := pivotBlock.block.height
+		visitList.PushBack(pivotBlock)
+		for e := visitList.Front(); e != nil; e = e.Next() {
+			block := *(e.Value.(*DetailedBlock))
+			if _, ok := epochs[block.block.index]; ok {
+				continue
+			}
+			epochs[block.block.index] = epoch
+			epochCnt.Incur(epoch, 1)
+			for _, refblock := range block.block.references {
+				visitList.PushBack(g.getDetailedBlock(refblock))
+			}
+			if !block.isGenesis() {
+				visitList.PushBack(block.parent)
+			}
+		}
+	}
+
+	return epochs, epochCnt
+}
@@ -0,0 +1,67 @@
+package simulator
+
+import "fmt"
+
+// Tie-break policies of the fork choice, which pick the pivot child among the
+// children of a block whose subtrees have the same weight.
+const (
+	TieResidual  = "residual"   // The larger residual of the geometric sampling of the block time (default)
+	TieHash      = "hash"       // The lower simulated hash of the block
+	TieFirstSeen = "first-seen" // The child the node has received first
+	TieRandom    = "random"     // A random order of the blocks, drawn independently by each node
+)
+
+var TieBreaks = []string{TieResidual, TieHash, TieFirstSeen, TieRandom}
+
+// tieBreak reports whether a node prefers a to b, two children of a block with
+// the same subtree weight.
+type tieBreak func(a, b *DetailedBlock) bool
+
+func validateTieBreak(kind string) error {
+	switch kind {
+	case "", TieResidual, TieHash, TieFirstSeen, TieRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown tie-break %q, expect one of %v", kind, TieBreaks)
+}
+
+// mix64 hashes two words into one, with the output function of splitmix64.
+func mix64(a uint64, b uint64) uint64 {
+	s := splitMix{state: a ^ b*0xbf58476d1ce4e5b9}
+	return s.Uint64()
+}
+
+// blockHash is the simulated hash of a block. It only depends on the seed and the
+// index of the block, so it draws nothing from the random streams and a run gives
+// the same blocks whatever the tie-break policy.
+func (o *Oracle) blockHash(index int) uint64 {
+	return mix64(uint64(deriveSeed(o.options.Seed, "hash")), uint64(index))
+}
+
+// setTieBreak makes a local graph of a miner break the ties of its fork choice
+// with the policy of the scenario.
+func (o *Oracle) setTieBreak(g *LocalGraph, miner int) {
+	switch o.options.TieBreak {
+	case TieHash:
+		g.tieBreak = func(a, b *DetailedBlock) bool {
+			return a.block.hash < b.block.hash
+		}
+	case TieFirstSeen:
+		g.tieBreak = func(a, b *DetailedBlock) bool {
+			return a.order < b.order
+		}
+	case TieRandom:
+		salt := uint64(deriveSeed(o.options.Seed, fmt.Sprintf("tie-break %d", miner)))
+		g.tieBreak = func(a, b *DetailedBlock) bool {
+			return mix64(salt, a.block.hash) < mix64(salt, b.block.hash)
+		}
+	default:
+		g.tieBreak = nil
+	}
+}
+
+// residualTieBreak is the rule of the original simulator: the residual of the
+// block time is a uniform draw in [0, 1) which is added to the subtree weight.
+func residualTieBreak(a, b *DetailedBlock) bool {
+	return a.block.residual > b.block.residual
+}
@@ -0,0 +1,358 @@
+package simulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A trace records the executed GenBlockEvent and SendBlockEvent of a run. Replaying
+// a trace re-drives the miners with the same block schedule and the same delivery
+// schedule, without simulating the network again.
+//
+// File format: the magic "CFXTRACE", a version byte, the number of miners (uvarint)
+// and the time precision (float64 bits), followed by the records. Each record is
+// a kind byte, the time since the previous record and the block index (uvarint).
+// A block record continues with the miner, the residual, the parent and the
+// references of the block; a delivery record continues with the receiver.
+
+const (
+	traceMagic   = "CFXTRACE"
+	traceVersion = 1
+)
+
+type TraceKind byte
+
+const (
+	TraceGenBlock TraceKind = iota + 1
+	TraceSendBlock
+)
+
+type TraceRecord struct {
+	Kind  TraceKind
+	Time  int64
+	Block int
+
+	// TraceGenBlock only
+	Miner      int
+	Residual   float64
+	Parent     int
+	References []int
+
+	// TraceSendBlock only
+	Receiver int
+}
+
+type TraceWriter struct {
+	w    *bufio.Writer
+	last int64
+	buf  []byte
+	err  error
+}
+
+func NewTraceWriter(w io.Writer, miners int, timePrecision float64) *TraceWriter {
+	tw := &TraceWriter{w: bufio.NewWriter(w), buf: make([]byte, binary.MaxVarintLen64)}
+	tw.write([]byte(traceMagic))
+	tw.write([]byte{traceVersion})
+	tw.uvarint(uint64(miners))
+	tw.uint64(math.Float64bits(timePrecision))
+	return tw
+}
+
+func (tw *TraceWriter) write(p []byte) {
+	if tw.err == nil {
+		_, tw.err = tw.w.Write(p)
+	}
+}
+
+func (tw *TraceWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(tw.buf, v)
+	tw.write(tw.buf[:n])
+}
+
+func (tw *TraceWriter) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(tw.buf, v)
+	tw.write(tw.buf[:8])
+}
+
+func (tw *TraceWriter) header(kind TraceKind, time int64, block int) {
+	tw.write([]byte{byte(kind)})
+	tw.uvarint(uint64(time - tw.last))
+	tw.uvarint(uint64(block))
+	tw.last = time
+}
+
+func (tw *TraceWriter) Write(r *TraceRecord) {
+	tw.header(r.Kind, r.Time, r.Block)
+	switch r.Kind {
+	case TraceGenBlock:
+		tw.uvarint(uint64(r.Miner))
+		tw.uint64(math.Float64bits(r.Residual))
+		tw.uvarint(uint64(r.Parent))
+		tw.uvarint(uint64(len(r.References)))
+		for _, ref := range r.References {
+			tw.uvarint(uint64(ref))
+		}
+	case TraceSendBlock:
+		tw.uvarint(uint64(r.Receiver))
+	}
+}
+
+func (tw *TraceWriter) recordEvent(event Event) {
+	switch e := event.(type) {
+	case *GenBlockEvent:
+		block := e.block
+		refs := make([]int, len(block.references))
+		for idx, ref := range block.references {
+			refs[idx] = ref.index
+		}
+		tw.Write(&TraceRecord{
+			Kind:       TraceGenBlock,
+			Time:       e.timestamp,
+			Block:      block.index,
+			Miner:      block.minerID,
+			Residual:   block.residual,
+			Parent:     block.parent.index,
+			References: refs,
+		})
+	case *SendBlockEvent:
+		tw.Write(&TraceRecord{
+			Kind:     TraceSendBlock,
+			Time:     e.timestamp,
+			Block:    e.block.index,
+			Receiver: e.receiverID,
+		})
+	}
+}
+
+// Flush writes the buffered records and returns the first error of the writer.
+func (tw *TraceWriter) Flush() error {
+	if tw.err == nil {
+		tw.err = tw.w.Flush()
+	}
+	return tw.err
+}
+
+type TraceReader struct {
+	r             *bufio.Reader
+	last          int64
+	Miners        int
+	TimePrecision float64
+}
+
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	tr := &TraceReader{r: bufio.NewReader(r)}
+	head := make([]byte, len(traceMagic)+1)
+	if _, err := io.ReadFull(tr.r, head); err != nil {
+		return nil, fmt.Errorf("trace header: %v", err)
+	}
+	if string(head[:len(traceMagic)]) != traceMagic {
+		return nil, errors.New("not a trace file")
+	}
+	if head[len(traceMagic)] != traceVersion {
+		return nil, fmt.Errorf("unsupported trace version %d", head[len(traceMagic)])
+	}
+	miners, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		return nil, fmt.Errorf("trace header: %v", err)
+	}
+	precision, err := tr.uint64()
+	if err != nil {
+		return nil, fmt.Errorf("trace header: %v", err)
+	}
+	tr.Miners = int(miners)
+	tr.TimePrecision = math.Float64frombits(precision)
+	return tr, nil
+}
+
+func (tr *TraceReader) uint64() (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(tr.r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// Next returns the next record, or io.EOF at the end of the trace.
+func (tr *TraceReader) Next() (*TraceRecord, error) {
+	kind, err := tr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]uint64, 2)
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(tr.r); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	r := &TraceRecord{Kind: TraceKind(kind), Time: tr.last + int64(fields[0]), Block: int(fields[1])}
+	tr.last = r.Time
+
+	switch r.Kind {
+	case TraceGenBlock:
+		var miner, parent, refNum, ref uint64
+		var residual uint64
+		if miner, err = binary.ReadUvarint(tr.r); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if residual, err = tr.uint64(); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if parent, err = binary.ReadUvarint(tr.r); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if refNum, err = binary.ReadUvarint(tr.r); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.Miner = int(miner)
+		r.Residual = math.Float64frombits(residual)
+		r.Parent = int(parent)
+		r.References = make([]int, refNum)
+		for i := range r.References {
+			if ref, err = binary.ReadUvarint(tr.r); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			r.References[i] = int(ref)
+		}
+	case TraceSendBlock:
+		receiver, err := binary.ReadUvarint(tr.r)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.Receiver = int(receiver)
+	default:
+		return nil, fmt.Errorf("unknown trace record kind %d", kind)
+	}
+	return r, nil
+}
+
+// ReplayNetwork is used when replaying a trace. All the deliveries come from the
+// trace, so it never schedules any event.
+type ReplayNetwork struct{}
+
+func (rn *ReplayNetwork) Setup(*Oracle) {}
+
+func (rn *ReplayNetwork) Broadcast(int, *Block) []Event {
+	return []Event{}
+}
+
+func (rn *ReplayNetwork) Relay(int, *Block) []Event {
+	return []Event{}
+}
+
+// ReplayEvent executes one record of the trace and schedules the next one.
+type ReplayEvent struct {
+	BaseEvent
+	reader *TraceReader
+	record *TraceRecord
+}
+
+func (e *ReplayEvent) Run(o *Oracle) []Event {
+	var events []Event
+	r := e.record
+	switch r.Kind {
+	case TraceGenBlock:
+		if o.draining {
+			break
+		}
+		if r.Block != len(o.blocks) {
+			log.Fatalf("trace generates block %d, expect block %d", r.Block, len(o.blocks))
+		}
+		block := o.newBlock(r.Miner, r.Residual)
+		events = o.runRecorded(&GenBlockEvent{BaseEvent: BaseEvent{timestamp: r.Time}, block: block})
+		o.replayStat.blocks++
+		if !sameEdges(block, r) {
+			o.replayStat.diverged++
+			log.Infof("Block %d has parent %d in the trace, %d in the replay", r.Block, r.Parent, block.parent.index)
+		}
+	case TraceSendBlock:
+		if r.Block >= len(o.blocks) {
+			break
+		}
+		events = o.runRecorded(&SendBlockEvent{BaseEvent: BaseEvent{timestamp: r.Time}, block: o.blocks[r.Block], receiverID: r.Receiver})
+	}
+
+	next, err := e.reader.Next()
+	if err == nil {
+		events = append(events, &ReplayEvent{BaseEvent: BaseEvent{timestamp: next.Time}, reader: e.reader, record: next})
+	} else if err != io.EOF {
+		log.Fatalf("read trace: %v", err)
+	}
+	return events
+}
+
+// runRecorded runs a recorded event as the queue would: the observers, the trace
+// hash and the recorder see it as in the recorded run, so the replay of a trace
+// has the hash of the recorded run and can be recorded again.
+func (o *Oracle) runRecorded(event Event) []Event {
+	o.beforeEvent(event)
+	events := event.Run(o)
+	o.afterEvent(event, events)
+	return events
+}
+
+func sameEdges(block *Block, r *TraceRecord) bool {
+	if block.parent.index != r.Parent || len(block.references) != len(r.References) {
+		return false
+	}
+	for idx, ref := range block.references {
+		if ref.index != r.References[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+type replayStat struct {
+	blocks   int
+	diverged int // Blocks whose parent or references differ from the trace
+}
+
+// RecordTrace makes the oracle write the executed block events to w. Call
+// FlushTrace after Run.
+func (o *Oracle) RecordTrace(w io.Writer) {
+	o.recorder = NewTraceWriter(w, o.LenMiner(), o.timePrecision)
+}
+
+func (o *Oracle) FlushTrace() error {
+	if o.recorder == nil {
+		return nil
+	}
+	return o.recorder.Flush()
+}
+
+// PrepareReplay is used instead of Prepare to drive the miners from a trace. The
+// oracle must have the same number of miners as the recorded run; its network is
+// replaced by a ReplayNetwork.
+func (o *Oracle) PrepareReplay(r io.Reader) error {
+	reader, err := NewTraceReader(r)
+	if err != nil {
+		return err
+	}
+	if reader.Miners != o.LenMiner() {
+		return fmt.Errorf("trace has %d miners, scenario has %d", reader.Miners, o.LenMiner())
+	}
+	if reader.TimePrecision != o.timePrecision {
+		return fmt.Errorf("trace has time precision %g, scenario has %g", reader.TimePrecision, o.timePrecision)
+	}
+	o.replaying = true
+	o.SetNetwork(&ReplayNetwork{})
+
+	first, err := reader.Next()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	o.queue.Push(&ReplayEvent{BaseEvent: BaseEvent{timestamp: first.Time}, reader: reader, record: first})
+	return nil
+}
+
+// ReplaySummary returns the number of replayed blocks and the number of blocks
+// which chose different edges than in the trace.
+func (o *Oracle) ReplaySummary() (int, int) {
+	return o.replayStat.blocks, o.replayStat.diverged
+}
@@ -0,0 +1,32 @@
+package simulator
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestReplayHash checks that the replay of a trace runs the block events through
+// the hooks of the oracle: it has the trace hash of the recorded run, and records
+// the same trace again.
+func TestReplayHash(t *testing.T) {
+	for _, network := range []string{"simple", "bitcoin"} {
+		cfg := testConfig(7)
+		cfg.Network.Type = network
+		var trace, again strings.Builder
+		recorded := runOracle(t, cfg, NewScenario, &trace)
+		replayed := runOracle(t, cfg, func(cfg *Config) (*Oracle, error) {
+			return NewReplayScenario(cfg, strings.NewReader(trace.String()))
+		}, &again)
+
+		blocks, diverged := replayed.ReplaySummary()
+		if blocks == 0 || diverged != 0 {
+			t.Fatalf("%s: replayed %d blocks, %d diverged", network, blocks, diverged)
+		}
+		if recorded.TraceHash() != replayed.TraceHash() {
+			t.Errorf("%s: recorded trace hash %x, replayed %x", network, recorded.TraceHash(), replayed.TraceHash())
+		}
+		if trace.String() != again.String() {
+			t.Errorf("%s: the replay recorded %d bytes of trace, the run %d", network, again.Len(), trace.Len())
+		}
+	}
+}
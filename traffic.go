@@ -1,10 +1,11 @@
-package main
+package simulator
 
 import (
 	"container/heap"
 	"container/list"
+	"fmt"
 	"math"
-	"math/rand"
+	"sort"
 )
 
 const logID = 7429
@@ -16,15 +17,16 @@ type Traffic struct {
 	nodes      map[int]*NodeOutbound
 }
 
-func NewTraffic(network *BitcoinNetwork) *Traffic {
+// NewTraffic creates the uplink model, bandwidth in Mbps and buffer size in MB.
+func NewTraffic(network *BitcoinNetwork, bandwidth float64, bufferSize float64, monopoly bool) *Traffic {
 	result := &Traffic{
 		network:    network,
-		bandwidth:  bandwidth_ * 128 * kb,
+		bandwidth:  bandwidth * 128 * kb,
 		nodes:      make(map[int]*NodeOutbound),
-		bufferSize: int64(bufferSize_*mb) + 1,
+		bufferSize: int64(bufferSize*mb) + 1,
 	}
-	if hasMonopoly_ {
-		result.nodes[0] = result.NewNodeOutbound(0)
+	if monopoly {
+		result.nodes[0] = result.NewNodeOutbound(0, 0)
 		result.nodes[0].bandwidth = 500.0 * 128 * kb
 		result.nodes[0].bufferSize = 32 * mb
 	}
@@ -32,6 +34,7 @@ func NewTraffic(network *BitcoinNetwork) *Traffic {
 }
 
 type NodeOutbound struct {
+	id          int
 	accSize     int64
 	lastWakeupT int64
 	nextWakeupE *WakeupTrafficEvent
@@ -42,9 +45,10 @@ type NodeOutbound struct {
 	bandwidth   float64
 }
 
-func (t *Traffic) NewNodeOutbound(currentTime int64) *NodeOutbound {
+func (t *Traffic) NewNodeOutbound(id int, currentTime int64) *NodeOutbound {
 	queue := make(PacketEventPriorityQueue, 0)
 	return &NodeOutbound{
+		id:          id,
 		accSize:     0,
 		lastWakeupT: currentTime,
 		queue:       &queue,
@@ -55,13 +59,16 @@ func (t *Traffic) NewNodeOutbound(currentTime int64) *NodeOutbound {
 	}
 }
 
-func (t *Traffic) addEvent(e *PacketEvent) []Event {
-	currentTime := t.network.oracle.timestamp
-
-	if _, ok := t.nodes[e.senderID]; !ok {
-		t.nodes[e.senderID] = t.NewNodeOutbound(currentTime)
+// node returns the uplink of a node, it is created on the first packet.
+func (t *Traffic) node(id int, currentTime int64) *NodeOutbound {
+	if _, ok := t.nodes[id]; !ok {
+		t.nodes[id] = t.NewNodeOutbound(id, currentTime)
 	}
-	sender := t.nodes[e.senderID]
+	return t.nodes[id]
+}
+
+func (t *Traffic) addEvent(e *PacketEvent) []Event {
+	sender := t.node(e.senderID, t.network.oracle.now(e.senderID))
 
 	if sender.buffer+e.size < sender.bufferSize {
 		return t.pushEvent(e)
@@ -87,13 +94,9 @@ func (t *Traffic) pullWaitingListAndUpdate(sender *NodeOutbound) []Event {
 
 func (t *Traffic) pushEvent(e *PacketEvent) []Event {
 	oracle := t.network.oracle
-	currentTime := t.network.oracle.timestamp
-
-	if _, ok := t.nodes[e.senderID]; !ok {
-		t.nodes[e.senderID] = t.NewNodeOutbound(currentTime)
-	}
+	currentTime := oracle.now(e.senderID)
 
-	sender := t.nodes[e.senderID]
+	sender := t.node(e.senderID, currentTime)
 
 	if sender.queue.Len() > 0 {
 		sender.accSize += int64(float64(currentTime-sender.lastWakeupT) * sender.bandwidth / (oracle.timePrecision * float64(sender.queue.Len())))
@@ -112,8 +115,8 @@ func (t *Traffic) pushEvent(e *PacketEvent) []Event {
 
 func (t *Traffic) popEvent(e *WakeupTrafficEvent) (*PacketEvent, []Event) {
 	sender := e.sender
-	currentTime := t.network.oracle.timestamp
 	oracle := t.network.oracle
+	currentTime := oracle.now(sender.id)
 
 	if sender.queue.Len() == 0 {
 		log.Fatal("Sequence Empty")
@@ -135,9 +138,13 @@ func (t *Traffic) popEvent(e *WakeupTrafficEvent) (*PacketEvent, []Event) {
 
 func (t *Traffic) updateNextWakeup(sender *NodeOutbound) []Event {
 	oracle := t.network.oracle
-	currentTime := t.network.oracle.timestamp
+	currentTime := oracle.now(sender.id)
 
 	if sender.queue.Len() == 0 {
+		if sender.nextWakeupE != nil {
+			// Only pending if the last packet has been removed.
+			oracle.cancel(sender.nextWakeupE)
+		}
 		sender.nextWakeupE = nil
 		return []Event{}
 	}
@@ -177,6 +184,37 @@ func (t *Traffic) updateNextWakeup(sender *NodeOutbound) []Event {
 	}
 }
 
+// remove takes a packet out of the uplink of its sender, the bandwidth it has
+// not used goes to the other packets. It returns false if the packet is not in
+// the uplink.
+func (t *Traffic) remove(e *PacketEvent) (bool, []Event) {
+	oracle := t.network.oracle
+	currentTime := oracle.now(e.senderID)
+
+	sender, ok := t.nodes[e.senderID]
+	if !ok {
+		return false, []Event{}
+	}
+	for item := sender.waiting.Front(); item != nil; item = item.Next() {
+		if item.Value.(*PacketEvent) == e {
+			sender.waiting.Remove(item)
+			return true, []Event{}
+		}
+	}
+	for idx, queued := range *sender.queue {
+		if queued != e {
+			continue
+		}
+		sender.accSize += int64(float64(currentTime-sender.lastWakeupT) * sender.bandwidth / (oracle.timePrecision * float64(sender.queue.Len())))
+		sender.lastWakeupT = currentTime
+
+		heap.Remove(sender.queue, idx)
+		sender.buffer -= e.size
+		return true, t.pullWaitingListAndUpdate(sender)
+	}
+	return false, []Event{}
+}
+
 type WakeupTrafficEvent struct {
 	BaseEvent
 	sender  *NodeOutbound
@@ -185,7 +223,7 @@ type WakeupTrafficEvent struct {
 
 func (e *WakeupTrafficEvent) Run(oracle *Oracle) []Event {
 	t := e.traffic
-	currentTime := e.traffic.network.oracle.timestamp
+	currentTime := oracle.now(e.sender.id)
 
 	if content, ok := t.nodes[logID]; ok && content == e.sender {
 		log.Noticef("Time %0.6f, Wake up, %d packets remains", float64(currentTime)/t.network.oracle.timePrecision, e.sender.queue.Len()-1)
@@ -193,8 +231,8 @@ func (e *WakeupTrafficEvent) Run(oracle *Oracle) []Event {
 
 	trafficE, wakeupR := e.traffic.popEvent(e)
 
-	trafficE.timestamp = currentTime + trafficE.pingDelay()
 	trafficE.status = sending
+	oracle.delay(e.sender.id, trafficE, currentTime, 1, trafficE)
 
 	result := append(wakeupR, trafficE)
 
@@ -233,7 +271,8 @@ func (e *PacketEvent) pingDelay() int64 {
 	oracle := network.oracle
 
 	loc1, loc2 := network.geo[e.senderID], network.geo[e.receiverID]
-	networkDelay := (geodelay[loc1][loc2] + 4*rand.Float64()) * (0.9 + 0.2*rand.Float64())
+	jitter := oracle.rand.Jitter
+	networkDelay := (geodelay[loc1][loc2] + 4*jitter.Float64()) * (0.9 + 0.2*jitter.Float64())
 	return int64(networkDelay / 1000 * oracle.timePrecision)
 }
 
@@ -274,11 +313,11 @@ func (e *PacketEvent) Sent(o *Oracle) []Event {
 //
 //	network.nextTime[e.senderID] = sentTime
 //	if e.senderID == 0 {
-//		log.Debugf("Time %0.2f, miner 0 update finish Time to %0.2f", network.oracle.getRealTime(), float64(sentTime)/network.oracle.timePrecision)
+//		log.Debugf("Time %0.2f, miner 0 update finish Time to %0.2f", network.oracle.RealTime(), float64(sentTime)/network.oracle.timePrecision)
 //		if e.size == int(blockSize_*mb) {
-//			log.Noticef("Time %0.2f, miner 0 update Time to %0.2f (%0.2fs). (Full block)", network.oracle.getRealTime(), float64(sentTime)/network.oracle.timePrecision, float64(sentTime)/network.oracle.timePrecision-network.oracle.getRealTime())
+//			log.Noticef("Time %0.2f, miner 0 update Time to %0.2f (%0.2fs). (Full block)", network.oracle.RealTime(), float64(sentTime)/network.oracle.timePrecision, float64(sentTime)/network.oracle.timePrecision-network.oracle.RealTime())
 //		} else if e.size == int(blockSize_*mb/50) {
-//			log.Noticef("Time %0.2f, miner 0 update Time to %0.2f (%0.2fs). (Compact block)", network.oracle.getRealTime(), float64(sentTime)/network.oracle.timePrecision, float64(sentTime)/network.oracle.timePrecision-network.oracle.getRealTime())
+//			log.Noticef("Time %0.2f, miner 0 update Time to %0.2f (%0.2fs). (Compact block)", network.oracle.RealTime(), float64(sentTime)/network.oracle.timePrecision, float64(sentTime)/network.oracle.timePrecision-network.oracle.RealTime())
 //		}
 //	}
 //	e.timestamp = sentTime + e.pingDelay()
@@ -295,3 +334,150 @@ func (e *PacketEvent) Sent(o *Oracle) []Event {
 //	realTime := float64(e.size) / (traffic.bandwidth)
 //	return int64(realTime * oracle.timePrecision)
 //}
+
+type packetKind byte
+
+const (
+	invPacket packetKind = iota + 1
+	getPacket
+	getCompactPacket
+)
+
+// packetState is the checkpoint of a packet, either waiting in the uplink of its
+// sender or in the event queue.
+type packetState struct {
+	Kind     packetKind
+	Time     int64
+	Sender   int
+	Receiver int
+	Size     int64
+	AccSize  int64
+	Status   PacketStatus
+	Block    int
+	Embedded bool // The queued event is the embedded *PacketEvent
+}
+
+func savePacket(e *PacketEvent) (*packetState, error) {
+	state := &packetState{
+		Time:     e.timestamp,
+		Sender:   e.senderID,
+		Receiver: e.receiverID,
+		Size:     e.size,
+		AccSize:  e.accSize,
+		Status:   e.status,
+	}
+	switch p := e.childPointer.(type) {
+	case *INVPacketEvent:
+		state.Kind, state.Block = invPacket, p.blockID
+	case *GETPacketEvent:
+		state.Kind, state.Block = getPacket, p.block.index
+	case *GETCompactPacketEvent:
+		state.Kind, state.Block = getCompactPacket, p.block.index
+	default:
+		return nil, fmt.Errorf("packet %T can not be checkpointed", e.childPointer)
+	}
+	return state, nil
+}
+
+// restorePacket returns the embedded *PacketEvent and the packet itself. A GET
+// packet is tracked by its request again, so the requests must be restored first.
+func (bn *BitcoinNetwork) restorePacket(state *packetState) (*PacketEvent, Event) {
+	base := PacketEvent{
+		BaseEvent:  BaseEvent{timestamp: state.Time},
+		network:    bn,
+		senderID:   state.Sender,
+		receiverID: state.Receiver,
+		size:       state.Size,
+		accSize:    state.AccSize,
+		status:     state.Status,
+	}
+	blocks := bn.oracle.blocks
+	switch state.Kind {
+	case invPacket:
+		p := &INVPacketEvent{PacketEvent: base, blockID: state.Block}
+		p.childPointer = p
+		return &p.PacketEvent, p
+	case getPacket:
+		p := &GETPacketEvent{PacketEvent: base, block: blocks[state.Block]}
+		p.childPointer = p
+		bn.trackPacket(p, p.senderID, p.receiverID, p.block)
+		return &p.PacketEvent, p
+	default:
+		p := &GETCompactPacketEvent{PacketEvent: base, block: blocks[state.Block]}
+		p.childPointer = p
+		bn.trackPacket(p, p.senderID, p.receiverID, p.block)
+		return &p.PacketEvent, p
+	}
+}
+
+type nodeOutboundState struct {
+	ID          int
+	AccSize     int64
+	LastWakeupT int64
+	Buffer      int64
+	Queue       []*packetState // In the order of the heap
+	Waiting     []*packetState
+}
+
+func (t *Traffic) saveState() ([]*nodeOutboundState, error) {
+	ids := make([]int, 0, len(t.nodes))
+	for id := range t.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	states := make([]*nodeOutboundState, 0, len(ids))
+	for _, id := range ids {
+		node := t.nodes[id]
+		state := &nodeOutboundState{
+			ID:          id,
+			AccSize:     node.accSize,
+			LastWakeupT: node.lastWakeupT,
+			Buffer:      node.buffer,
+		}
+		for _, e := range *node.queue {
+			packet, err := savePacket(e)
+			if err != nil {
+				return nil, err
+			}
+			state.Queue = append(state.Queue, packet)
+		}
+		for item := node.waiting.Front(); item != nil; item = item.Next() {
+			packet, err := savePacket(item.Value.(*PacketEvent))
+			if err != nil {
+				return nil, err
+			}
+			state.Waiting = append(state.Waiting, packet)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// loadState restores the uplinks. The bandwidth and the buffer size are taken
+// from the current parameters, so they can be changed when a run is resumed.
+// The pending wakeup events are restored with the event queue.
+func (t *Traffic) loadState(states []*nodeOutboundState) {
+	for _, state := range states {
+		node, ok := t.nodes[state.ID]
+		if !ok {
+			node = t.NewNodeOutbound(state.ID, state.LastWakeupT)
+			t.nodes[state.ID] = node
+		}
+		node.accSize = state.AccSize
+		node.lastWakeupT = state.LastWakeupT
+		node.buffer = state.Buffer
+		node.nextWakeupE = nil
+		queue := make(PacketEventPriorityQueue, 0, len(state.Queue))
+		for _, packet := range state.Queue {
+			e, _ := t.network.restorePacket(packet)
+			queue = append(queue, e)
+		}
+		node.queue = &queue
+		node.waiting = list.New()
+		for _, packet := range state.Waiting {
+			e, _ := t.network.restorePacket(packet)
+			node.waiting.PushBack(e)
+		}
+	}
+}
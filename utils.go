@@ -1,11 +1,13 @@
-package main
+package simulator
 
 import (
-	"container/heap"
 	"os"
-	"./go-logging"
+	"sort"
+	"github.com/Conflux-Chain/conflux-simulator/go-logging"
 )
 
+var log = logging.MustGetLogger("simulator")
+
 func UNUSED(v interface{}) {
 	_ = v
 }
@@ -14,14 +16,20 @@ type EventPriorityQueue []Event
 
 func (pq EventPriorityQueue) Len() int { return len(pq) }
 
+// Events with the same timestamp run in insertion order, so a run only depends on
+// its seed.
 func (pq EventPriorityQueue) Less(i, j int) bool {
-	return pq[i].GetTimestamp() < pq[j].GetTimestamp()
+	ei, ej := pq[i].base(), pq[j].base()
+	if ei.timestamp != ej.timestamp {
+		return ei.timestamp < ej.timestamp
+	}
+	return ei.seq < ej.seq
 }
 
 func (pq EventPriorityQueue) Swap(i, j int) {
 	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].SetIndex(i)
-	pq[j].SetIndex(j)
+	pq[i].base().index = i
+	pq[j].base().index = j
 }
 
 func (pq *EventPriorityQueue) Push(x interface{}) {
@@ -69,21 +77,100 @@ func (pq *PacketEventPriorityQueue) Peek() *PacketEvent {
 }
 
 type EventQueue struct {
-	queueList *EventPriorityQueue
+	sched   scheduler
+	nextSeq uint64
+}
+
+// Push schedules an event. A cancelled event is dropped.
+func (eq *EventQueue) Push(x Event) {
+	if x.base().cancelled {
+		return
+	}
+	x.base().fired = false
+	x.SetSeq(eq.nextSeq)
+	eq.nextSeq++
+	eq.sched.push(x)
+	x.SetQueue(eq)
+}
+
+// restore pushes an event of a checkpoint, which keeps its sequence number.
+func (eq *EventQueue) restore(x Event) {
+	eq.sched.push(x)
+	x.SetQueue(eq)
 }
 
-func (eq EventQueue) Push(x Event) {
-	heap.Push(eq.queueList, x)
-	x.SetQueue(&eq)
+func (eq *EventQueue) Len() int {
+	return eq.sched.Len()
 }
 
-func (eq EventQueue) Pop() Event {
-	x := heap.Pop(eq.queueList).(Event)
+func (eq *EventQueue) Pop() Event {
+	x := eq.sched.pop()
 	x.SetQueue(nil)
+	x.base().fired = true
 	return x
 }
 
-func loadLogger(level logging.Level) {
+// peek returns the next event to pop, nil if the queue is empty.
+func (eq *EventQueue) peek() Event {
+	if eq.sched.Len() == 0 {
+		return nil
+	}
+	return eq.sched.peek()
+}
+
+// Cancel calls off an event which has not fired. A queued event is removed from
+// the queue; an event not pushed yet, e.g. in the results of the running event,
+// is dropped when it is pushed. Cancelling an event which has fired or has been
+// cancelled does nothing. It reports whether the event was called off.
+func (eq *EventQueue) Cancel(x Event) bool {
+	e := x.base()
+	if e.fired || e.cancelled {
+		return false
+	}
+	if e.eq != nil {
+		if e.eq != eq {
+			log.Panic("cancel an event of another queue")
+		}
+		eq.sched.remove(e)
+		e.eq = nil
+	}
+	e.cancelled = true
+	return true
+}
+
+// CancelToken is kept by the component which schedules an event it may call off
+// later, e.g. a timeout. Cancel is safe whether the event is queued, not pushed
+// yet or fired already, and a nil token cancels nothing.
+type CancelToken struct {
+	event Event
+}
+
+func NewCancelToken(event Event) *CancelToken {
+	return &CancelToken{event: event}
+}
+
+// Cancel calls off the event, see EventQueue.Cancel. The token forgets the event
+// afterwards.
+func (t *CancelToken) Cancel(o *Oracle) bool {
+	if t == nil || t.event == nil {
+		return false
+	}
+	event := t.event
+	t.event = nil
+	return o.cancel(event)
+}
+
+// Pending reports whether the event may still fire.
+func (t *CancelToken) Pending() bool {
+	if t == nil || t.event == nil {
+		return false
+	}
+	e := t.event.base()
+	return !e.fired && !e.cancelled
+}
+
+// LoadLogger sends the log of the simulator to stdout.
+func LoadLogger(level logging.Level) {
 	formatter := logging.MustStringFormatter(
 		"%{color}%{time:15:04:05.0000} [%{level:.4s}] %{shortfile: 20.20s} %{shortfunc: 10.10s} %{module: 5.5s}▶ %{color:reset}%{message} ",
 	)
@@ -191,7 +278,7 @@ func (s *Set) Has(item int) bool {
 }
 
 func (s *Set) Len() int {
-	return len(s.List())
+	return len(s.m)
 }
 
 func (s *Set) Clear() {
@@ -205,10 +292,12 @@ func (s *Set) IsEmpty() bool {
 	return false
 }
 
+// List returns the items in increasing order, so iterating a set is deterministic.
 func (s *Set) List() []int {
-	var list []int
+	list := make([]int, 0, len(s.m))
 	for item := range s.m {
 		list = append(list, item)
 	}
+	sort.Ints(list)
 	return list
 }